@@ -0,0 +1,156 @@
+package connect_backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+//The number of elements restored at once when restoring a directory or prefix, unless Parallelism is set
+const defaultParallelism = 4
+
+//RestoreResult is the outcome of restoring one element as part of a bulk restore
+type RestoreResult struct {
+	Name   string
+	Source string
+	Err    error
+}
+
+//IsBulk reports if the source is a directory, S3 prefix or archive rather than a single json, or a stream of elements
+//on standard input when no name is given
+func (cr ConnectRestore) IsBulk() bool {
+	if stdin, ok := cr.Reader.(*StdinReader); ok {
+		return cr.Name == "" && stdin.isStream()
+	}
+	if isArchive(cr.Source) {
+		return true
+	}
+	s3Location, err := url.Parse(cr.Source)
+	if err == nil && s3Location.Scheme == "s3" {
+		_, _, element := splitFormat(s3Location.Path)
+		return !element
+	}
+	info, err := os.Stat(cr.Source)
+	return err == nil && info.IsDir()
+}
+
+//RestoreAll restores every element of the restore type found under the source directory or S3 prefix whose name
+//matches the Include globs, if any, and none of the Exclude globs.  A result is returned for every element attempted.
+func (cr ConnectRestore) RestoreAll() ([]RestoreResult, error) {
+
+	objects, err := cr.listBackup(cr.Source)
+	if err != nil {
+		return nil, errors.New("could not list " + cr.Source + ": " + err.Error())
+	}
+
+	var selected []backupObject
+	for _, v := range objects {
+		if v.element != cr.Element {
+			continue
+		}
+		included, err := cr.included(v.name)
+		if err != nil {
+			return nil, err
+		}
+		if included {
+			selected = append(selected, v)
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, errors.New("no " + string(cr.Element) + " found under " + cr.Source)
+	}
+
+	parallelism := cr.Parallelism
+	if parallelism < 1 {
+		parallelism = defaultParallelism
+	}
+
+	results := make([]RestoreResult, len(selected))
+	limit := make(chan bool, parallelism)
+	var wg sync.WaitGroup
+
+	for i, v := range selected {
+		wg.Add(1)
+		limit <- true
+		go func(i int, object backupObject) {
+			defer wg.Done()
+			defer func() { <-limit }()
+
+			single := cr
+			single.Source = object.location
+			//elements read from standard input are found by their name
+			if single.Reader != nil {
+				single.Name = object.name
+			}
+			results[i] = RestoreResult{
+				Name:   object.name,
+				Source: object.location,
+				Err:    single.Restore(),
+			}
+		}(i, v)
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+func (cr ConnectRestore) included(name string) (bool, error) {
+
+	for _, v := range cr.Exclude {
+		matched, err := filepath.Match(v, name)
+		if err != nil {
+			return false, errors.New("bad exclude pattern " + v + ": " + err.Error())
+		}
+		if matched {
+			return false, nil
+		}
+	}
+
+	if len(cr.Include) == 0 {
+		return true, nil
+	}
+
+	for _, v := range cr.Include {
+		matched, err := filepath.Match(v, name)
+		if err != nil {
+			return false, errors.New("bad include pattern " + v + ": " + err.Error())
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//PrintSummary lists which elements of a bulk restore succeeded and which failed, and returns the number that failed
+func PrintSummary(results []RestoreResult, out io.Writer) int {
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+
+	var failed int
+	fmt.Fprintln(out, "Restored:")
+	for _, v := range results {
+		if v.Err == nil {
+			fmt.Fprintln(out, "  "+v.Name)
+		}
+	}
+
+	fmt.Fprintln(out, "Failed:")
+	for _, v := range results {
+		if v.Err != nil {
+			failed++
+			fmt.Fprintln(out, "  "+v.Name+": "+v.Err.Error())
+		}
+	}
+
+	fmt.Fprintf(out, "%d succeeded, %d failed\n", len(results)-failed, failed)
+	return failed
+}
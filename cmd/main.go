@@ -1,10 +1,16 @@
 package main
 
 import (
+	"io"
 	"log"
+	"net/url"
 	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
 
 	"github.com/aws/aws-sdk-go/service/connect"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/sethkor/connect-backup"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
@@ -15,23 +21,113 @@ var (
 	pRegion   = app.Flag("region", "AWS region").String()
 	pInstance = app.Flag("instance", "The AWS Connect instance id to backup").String()
 
-	pBackupCommand = app.Command("backup", "Backup your instance")
-	pFile          = pBackupCommand.Flag("file", "Write output to file with the provided path").ExistingDir()
-	pS3            = pBackupCommand.Flag("s3", "Write file to S3 destination with path as a url").URL()
-	pRawFlow       = pBackupCommand.Flag("flows-raw", "writes the raw flow as an unescaped json object without the encapsulating connect ContactFlow object data").Default("false").Bool()
-	pFlowName      = pBackupCommand.Flag("flow-name", "name of a specific flow to backup/export").String()
+	pS3Endpoint            = app.Flag("s3-endpoint", "Send S3 requests to this endpoint instead of AWS, e.g. http://localhost:9000 for MinIO").String()
+	pS3PathStyle           = app.Flag("s3-path-style", "Put the bucket in the path of S3 URLs rather than the host name, as most S3 compatible stores need").Default("false").Bool()
+	pS3ExpectedBucketOwner = app.Flag("s3-expected-bucket-owner", "Account id the S3 buckets read and written must belong to").String()
+
+	pBackupCommand    = app.Command("backup", "Backup your instance")
+	pFile             = pBackupCommand.Flag("file", "Write output to file with the provided path").ExistingDir()
+	pS3               = pBackupCommand.Flag("s3", "Write file to S3 destination with path as a url").URL()
+	pArchive          = pBackupCommand.Flag("archive", "Write the backup into a single .tar.gz or .zip archive, either a local file or an S3 URL").String()
+	pGit              = pBackupCommand.Flag("git", "Write the backup into this git repository, creating it if needed, and commit the changes once it is done").String()
+	pGitRemote        = pBackupCommand.Flag("git-remote", "Push the commit made with --git to this remote").String()
+	pRawFlow          = pBackupCommand.Flag("flows-raw", "writes the raw flow as an unescaped json object without the encapsulating connect ContactFlow object data").Default("false").Bool()
+	pFormat           = pBackupCommand.Flag("format", "Format to write each element in, yaml expands the content of flows so it is easier to review").Default(string(connect_backup.FormatJSON)).Enum(string(connect_backup.FormatJSON), string(connect_backup.FormatYAML))
+	pNDJSON           = pBackupCommand.Flag("ndjson", "When writing to stdout, print each element on one line in an envelope giving its type, instance, name and id, which restore can read from stdin").Default("false").Bool()
+	pSnapshots        = pBackupCommand.Flag("snapshots", "Write the backup to a new <instance id>/<timestamp> snapshot rather than over the previous backup").Default("false").Bool()
+	pIncremental      = pBackupCommand.Flag("incremental", "Only write the elements which have changed since the last backup to --file or --s3, reporting how many were new, changed and unchanged").Default("false").Bool()
+	pKmsKeyId         = pBackupCommand.Flag("kms-key-id", "Encrypt each element with a data key from this KMS key").String()
+	pKeyFile          = pBackupCommand.Flag("key-file", "Encrypt each element with a data key wrapped by the base64 encoded 32 byte key in this file").ExistingFile()
+	pS3SSEKMSKeyId    = pBackupCommand.Flag("s3-sse-kms-key-id", "Encrypt the objects written to S3 with SSE-KMS under this key").String()
+	pS3StorageClass   = pBackupCommand.Flag("s3-storage-class", "Storage class of the objects written to S3").Enum(s3.StorageClass_Values()...)
+	pS3Tags           = pBackupCommand.Flag("s3-tag", "Tag to add to the objects written to S3 as key=value.  Can be repeated").StringMap()
+	pS3ObjectLockMode = pBackupCommand.Flag("s3-object-lock-mode", "Object Lock retention mode of the objects written to S3.  The bucket must have Object Lock enabled").Enum(s3.ObjectLockMode_Values()...)
+	pS3ObjectLockDays = pBackupCommand.Flag("s3-object-lock-days", "How many days the objects written to S3 are retained for with --s3-object-lock-mode").Int()
+	pS3LegalHold      = pBackupCommand.Flag("s3-legal-hold", "Place a legal hold on the objects written to S3.  The bucket must have Object Lock enabled").Default("false").Bool()
+	pFlowName         = pBackupCommand.Flag("flow-name", "name of a specific flow to backup/export").String()
 
 	pRestoreCommand = app.Command("restore", "Restore a connect component")
-	pType           = pRestoreCommand.Flag("type", "Type to restore.  must be one of flow,routing-profile,user,user-hierarchy-group,user-hierarchy-structure").Required().Enum(
+	pType           = pRestoreCommand.Flag("type", "Type to restore.  must be one of flow,routing-profile,user,hours-of-operation,queues,user-hierarchy-group,user-hierarchy-structure").Required().Enum(
 		string(connect_backup.Flows),
 		string(connect_backup.RoutingProfiles),
 		string(connect_backup.Users),
+		string(connect_backup.HoursOfOperation),
+		string(connect_backup.Queues),
 		string(connect_backup.UserHierarchyGroups),
 		string(connect_backup.UserHierarchyStructure))
-	pCreate = pRestoreCommand.Flag("create", "Restore contact flow as a new created flow with new name instead of overwriting").String()
-	pSource = pRestoreCommand.Arg("json", "Location of restoration json (s3 URL or file)").Required().String()
+	pCreate                 = pRestoreCommand.Flag("create", "Restore contact flow as a new created flow with new name instead of overwriting").String()
+	pMapping                = pRestoreCommand.Flag("mapping", "YAML or JSON file of source to target ARN, id, name and account id substitutions for restoring into another environment").ExistingFile()
+	pPlan                   = pRestoreCommand.Flag("plan", "Print the changes and API calls the restore would make without making them").Default("false").Bool()
+	pPlanFile               = pRestoreCommand.Flag("plan-file", "Save the plan to a file so it can be applied later with apply.  Implies --plan").String()
+	pSnapshotFile           = pRestoreCommand.Flag("snapshot-file", "Directory to save the live element to under pre-restore/<timestamp> before it is overwritten").ExistingDir()
+	pSnapshotS3             = pRestoreCommand.Flag("snapshot-s3", "S3 destination url to save the live element to under pre-restore/<timestamp> before it is overwritten").URL()
+	pRollback               = pRestoreCommand.Flag("rollback", "Put back the saved live element if the restore fails part way through").Default("false").Bool()
+	pAsOf                   = pRestoreCommand.Flag("as-of", "For S3 sources in a versioned bucket, restore the version that was current at this RFC3339 timestamp").String()
+	pVersionId              = pRestoreCommand.Flag("version-id", "For S3 sources in a versioned bucket, restore this version").String()
+	pBackupRoot             = pRestoreCommand.Flag("backup-root", "Directory or S3 URL the backup was written to, used with --name instead of the location of the json").String()
+	pName                   = pRestoreCommand.Flag("name", "Name of the element to find under --backup-root").String()
+	pInclude                = pRestoreCommand.Flag("include", "When restoring a directory or S3 prefix, only restore names matching this glob.  Can be repeated").Strings()
+	pExclude                = pRestoreCommand.Flag("exclude", "When restoring a directory or S3 prefix, don't restore names matching this glob.  Can be repeated").Strings()
+	pParallel               = pRestoreCommand.Flag("parallel", "When restoring a directory or S3 prefix, how many elements to restore at once").Default("4").Int()
+	pUpdateExisting         = pRestoreCommand.Flag("update-existing", "When creating a user with --create, update the user in place if the username already exists").Default("false").Bool()
+	pCredentialPublicKey    = pRestoreCommand.Flag("credential-public-key", "PEM RSA public key to encrypt the initial password of created users with.  Written to --credential-dir").ExistingFile()
+	pCredentialDir          = pRestoreCommand.Flag("credential-dir", "Directory to write the encrypted initial passwords of created users to").ExistingDir()
+	pCredentialSecretPrefix = pRestoreCommand.Flag("credential-secret-prefix", "Store the initial password of created users in AWS Secrets Manager with this prefix before the username").String()
+	pRestoreKeyFile         = pRestoreCommand.Flag("key-file", "Key file to decrypt a backup encrypted with --key-file.  Backups encrypted with KMS are decrypted without it").ExistingFile()
+	pVerify                 = pRestoreCommand.Flag("verify", "Describe the element again after restoring it and fail if it doesn't match the backup").Default("false").Bool()
+	pSource                 = pRestoreCommand.Arg("json", "Location of restoration json (s3 URL, file, archive.tar.gz#path/in/archive.json or - for stdin, including the output of backup --ndjson), or a directory, S3 prefix or archive to restore every element of the type in").String()
 	//pDestInstanceArn = pRestoreCommand.Flag("dest-arn", "Arn of the connect instance to restore to if different to the source").String()
 
+	pApplyCommand                = app.Command("apply", "Apply a restore plan previously saved with restore --plan-file")
+	pApplySnapshotFile           = pApplyCommand.Flag("snapshot-file", "Directory to save the live element to under pre-restore/<timestamp> before it is overwritten").ExistingDir()
+	pApplySnapshotS3             = pApplyCommand.Flag("snapshot-s3", "S3 destination url to save the live element to under pre-restore/<timestamp> before it is overwritten").URL()
+	pApplyRollback               = pApplyCommand.Flag("rollback", "Put back the saved live element if the plan fails part way through").Default("false").Bool()
+	pApplyCredentialPublicKey    = pApplyCommand.Flag("credential-public-key", "PEM RSA public key to encrypt the initial password of created users with.  Written to --credential-dir").ExistingFile()
+	pApplyCredentialDir          = pApplyCommand.Flag("credential-dir", "Directory to write the encrypted initial passwords of created users to").ExistingDir()
+	pApplyCredentialSecretPrefix = pApplyCommand.Flag("credential-secret-prefix", "Store the initial password of created users in AWS Secrets Manager with this prefix before the username").String()
+	pApplyKeyFile                = pApplyCommand.Flag("key-file", "Key file the source of the plan was encrypted with, to encrypt the saved live element with.  Sources encrypted with KMS don't need it").ExistingFile()
+	pPlanSource                  = pApplyCommand.Arg("plan", "Location of the saved plan").Required().ExistingFile()
+
+	pSyncCommand                = app.Command("sync", "Make the instance match a backup, creating and updating hours of operation, queues, flows, routing profiles and users")
+	pSyncMapping                = pSyncCommand.Flag("mapping", "YAML or JSON file of source to target ARN, id, name and account id substitutions for syncing into another environment").ExistingFile()
+	pSyncDelete                 = pSyncCommand.Flag("delete", "Also delete live hours of operation, flows and users which aren't in the backup").Default("false").Bool()
+	pSyncSnapshotFile           = pSyncCommand.Flag("snapshot-file", "Directory to save live elements to under pre-restore/<timestamp> before they are changed").ExistingDir()
+	pSyncSnapshotS3             = pSyncCommand.Flag("snapshot-s3", "S3 destination url to save live elements to under pre-restore/<timestamp> before they are changed").URL()
+	pSyncCredentialPublicKey    = pSyncCommand.Flag("credential-public-key", "PEM RSA public key to encrypt the initial password of created users with.  Written to --credential-dir").ExistingFile()
+	pSyncCredentialDir          = pSyncCommand.Flag("credential-dir", "Directory to write the encrypted initial passwords of created users to").ExistingDir()
+	pSyncCredentialSecretPrefix = pSyncCommand.Flag("credential-secret-prefix", "Store the initial password of created users in AWS Secrets Manager with this prefix before the username").String()
+	pSyncKeyFile                = pSyncCommand.Flag("key-file", "Key file to decrypt a backup encrypted with --key-file.  Backups encrypted with KMS are decrypted without it").ExistingFile()
+	pSyncSource                 = pSyncCommand.Arg("backup", "Directory or S3 URL of the backup of the instance").Required().String()
+
+	pCreateInstanceCommand                = app.Command("create-instance-from-backup", "Create a new instance set up like the backed up instance and restore the backup into it")
+	pCreateInstanceAlias                  = pCreateInstanceCommand.Flag("alias", "Alias of the new instance").Required().String()
+	pCreateInstanceDirectoryId            = pCreateInstanceCommand.Flag("directory-id", "Directory for the new instance, needed if the backed up instance used an existing directory").String()
+	pCreateInstanceMapping                = pCreateInstanceCommand.Flag("mapping", "YAML or JSON file of source to target substitutions for anything not in the backup, such as security profiles").ExistingFile()
+	pCreateInstanceIdMap                  = pCreateInstanceCommand.Flag("id-map", "File to write the source to target id mapping to").Default("id-map.yaml").String()
+	pCreateInstanceCredentialPublicKey    = pCreateInstanceCommand.Flag("credential-public-key", "PEM RSA public key to encrypt the initial password of created users with.  Written to --credential-dir").ExistingFile()
+	pCreateInstanceCredentialDir          = pCreateInstanceCommand.Flag("credential-dir", "Directory to write the encrypted initial passwords of created users to").ExistingDir()
+	pCreateInstanceCredentialSecretPrefix = pCreateInstanceCommand.Flag("credential-secret-prefix", "Store the initial password of created users in AWS Secrets Manager with this prefix before the username").String()
+	pCreateInstanceKeyFile                = pCreateInstanceCommand.Flag("key-file", "Key file to decrypt a backup encrypted with --key-file.  Backups encrypted with KMS are decrypted without it").ExistingFile()
+	pCreateInstanceSource                 = pCreateInstanceCommand.Arg("backup", "Directory or S3 URL of the backup of the instance").Required().String()
+
+	pSnapshotsCommand = app.Command("snapshots", "List the snapshots of each instance in a backup with the number of elements in each")
+	pSnapshotsSource  = pSnapshotsCommand.Arg("backup", "Directory or S3 URL the backup was written to").Required().String()
+
+	pVerifyCommand = app.Command("verify", "Check every element of a backup against its manifest, that it can be read back and that the elements it refers to are in the backup")
+	pVerifyKeyFile = pVerifyCommand.Flag("key-file", "Key file to decrypt a backup encrypted with --key-file.  Backups encrypted with KMS are decrypted without it").ExistingFile()
+	pVerifySource  = pVerifyCommand.Arg("backup", "Directory, S3 URL or archive the backup was written to").Required().String()
+
+	pPruneCommand = app.Command("prune", "Delete the snapshots in a backup which aren't kept by the daily, weekly and monthly retention.  The latest snapshot of each instance is always kept")
+	pPruneDaily   = pPruneCommand.Flag("daily", "How many days to keep the newest snapshot of").Default("7").Int()
+	pPruneWeekly  = pPruneCommand.Flag("weekly", "How many weeks to keep the newest snapshot of").Default("4").Int()
+	pPruneMonthly = pPruneCommand.Flag("monthly", "How many months to keep the newest snapshot of").Default("12").Int()
+	pPruneDryRun  = pPruneCommand.Flag("dry-run", "List the snapshots which would be kept and deleted without deleting anything").Default("false").Bool()
+	pPruneKeyFile = pPruneCommand.Flag("key-file", "Key file to read the manifests of a backup encrypted with --key-file, which tell which snapshots succeeded").ExistingFile()
+	pPruneSource  = pPruneCommand.Arg("backup", "Directory or S3 URL the backup was written to").Required().String()
+
+	pVersionsCommand = app.Command("versions", "List the versions of an element backed up to a versioned S3 bucket")
+	pVersionsSource  = pVersionsCommand.Arg("json", "S3 URL of the backed up element").Required().String()
+
 	pRenameFlowsCommand = app.Command("rename-flows", "Rename all demo call flows with a prefix.  Defaults to just the AWS Demo flows")
 	pPrefix             = pRenameFlowsCommand.Flag("prefix", "Prefix to use").Default("~").String()
 	pAllFlows           = pRenameFlowsCommand.Flag("all-flows", "Rename all flows").Default("false").Bool()
@@ -43,6 +139,49 @@ var (
 	date    = "unknown"
 )
 
+//snapshotWriter returns where live elements are saved before they are changed, or nil if no location was given, in
+//which case nothing is saved
+func snapshotWriter(file string, s3 *url.URL, sess *session.Session) connect_backup.Writer {
+	if s3 != nil {
+		return &connect_backup.S3Writer{
+			Destination: *s3,
+			Sess:        sess,
+		}
+	}
+	if file != "" {
+		return &connect_backup.FileWriter{
+			BasePath: file,
+		}
+	}
+	return nil
+}
+
+func credentialStore(publicKey string, dir string, secretPrefix string, sess *session.Session) connect_backup.CredentialStore {
+	if publicKey != "" {
+		return connect_backup.PublicKeyCredentialStore{
+			PublicKeyFile: publicKey,
+			Directory:     dir,
+		}
+	}
+	if secretPrefix != "" {
+		return connect_backup.SecretsManagerCredentialStore{
+			Sess:   sess,
+			Prefix: secretPrefix,
+		}
+	}
+	return nil
+}
+
+//localKeys returns the keys held in the key file, if one was given
+func localKeys(keyFile string) connect_backup.KeyWrapper {
+	if keyFile == "" {
+		return nil
+	}
+	return connect_backup.LocalKeys{
+		KeyFile: keyFile,
+	}
+}
+
 func main() {
 
 	app.Version(version + " " + date + " " + commit)
@@ -51,11 +190,42 @@ func main() {
 
 	command := kingpin.MustParse(app.Parse(os.Args[1:]))
 	var err error
-	sess := connect_backup.GetAwsSession(*pProfile, *pRegion)
+	s3Options := connect_backup.S3Options{
+		ExpectedBucketOwner: *pS3ExpectedBucketOwner,
+		Endpoint:            *pS3Endpoint,
+		PathStyle:           *pS3PathStyle,
+	}
+	sess := s3Options.Session(connect_backup.GetAwsSession(*pProfile, *pRegion))
 
 	switch command {
 	case pBackupCommand.FullCommand():
-		var theWriter connect_backup.Writer = &connect_backup.StdoutWriter{}
+		s3Options.KMSKeyId = *pS3SSEKMSKeyId
+		s3Options.StorageClass = *pS3StorageClass
+		s3Options.Tags = *pS3Tags
+		s3Options.ObjectLockMode = *pS3ObjectLockMode
+		s3Options.ObjectLockDays = *pS3ObjectLockDays
+		s3Options.LegalHold = *pS3LegalHold
+
+		destinations := 0
+		for _, v := range []bool{*pFile != "", *pS3 != nil, *pArchive != "", *pGit != ""} {
+			if v {
+				destinations++
+			}
+		}
+		if destinations > 1 {
+			app.FatalUsage("only one of --file, --s3, --archive and --git can be used\n")
+		}
+		if *pNDJSON && destinations > 0 {
+			app.FatalUsage("--ndjson only applies to the backup written to stdout, it can't be used with --file, --s3, --archive or --git\n")
+		}
+		if *pGitRemote != "" && *pGit == "" {
+			app.FatalUsage("--git-remote can only be used with --git\n")
+		}
+		if *pNDJSON && *pFormat == string(connect_backup.FormatYAML) {
+			app.FatalUsage("--ndjson writes json, it can't be used with --format yaml\n")
+		}
+
+		var theWriter connect_backup.Writer = &connect_backup.StdoutWriter{NDJSON: *pNDJSON}
 		if *pFile != "" {
 			theWriter = &connect_backup.FileWriter{
 				BasePath: *pFile + string(os.PathSeparator),
@@ -64,6 +234,36 @@ func main() {
 			theWriter = &connect_backup.S3Writer{
 				Destination: *(*pS3),
 				Sess:        sess,
+				Options:     s3Options,
+			}
+		} else if *pArchive != "" {
+			theWriter = &connect_backup.ArchiveWriter{
+				Destination: *pArchive,
+				Sess:        sess,
+				Options:     s3Options,
+			}
+		} else if *pGit != "" {
+			theWriter = &connect_backup.GitWriter{
+				Repository: *pGit,
+				Remote:     *pGitRemote,
+			}
+		}
+
+		if *pKmsKeyId != "" && *pKeyFile != "" {
+			app.FatalUsage("only one of --kms-key-id and --key-file can be used\n")
+		}
+		if *pKmsKeyId != "" {
+			theWriter = &connect_backup.EncryptingWriter{
+				Writer: theWriter,
+				Keys: connect_backup.KMSKeys{
+					KeyId: *pKmsKeyId,
+					Sess:  sess,
+				},
+			}
+		} else if *pKeyFile != "" {
+			theWriter = &connect_backup.EncryptingWriter{
+				Writer: theWriter,
+				Keys:   localKeys(*pKeyFile),
 			}
 		}
 
@@ -71,9 +271,13 @@ func main() {
 			ConnectInstance: connect.Instance{
 				Id: pInstance,
 			},
-			TheWriter: theWriter,
-			Svc:       connect.New(sess),
-			RawFlow:   *pRawFlow,
+			TheWriter:   theWriter,
+			Svc:         connect.New(sess),
+			RawFlow:     *pRawFlow,
+			Snapshots:   *pSnapshots,
+			Incremental: *pIncremental,
+			Version:     version,
+			Format:      connect_backup.Format(*pFormat),
 		}
 
 		if *pFlowName == "" {
@@ -82,16 +286,191 @@ func main() {
 			err = cb.BackupFlowByName(*pFlowName)
 		}
 
+		if closer, ok := theWriter.(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+
 	case pRestoreCommand.FullCommand():
 
+		if *pSource == "" && (*pBackupRoot == "" || *pName == "") {
+			app.FatalUsage("either the location of the json or --backup-root and --name must be passed\n")
+		}
+		if *pRollback && *pSnapshotFile == "" && *pSnapshotS3 == nil {
+			app.FatalUsage("--rollback needs --snapshot-file or --snapshot-s3 to save the live element to\n")
+		}
+
+		var theMapping *connect_backup.Mapping
+		if *pMapping != "" {
+			theMapping, err = connect_backup.LoadMapping(*pMapping)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		var asOf time.Time
+		if *pAsOf != "" {
+			asOf, err = time.Parse(time.RFC3339, *pAsOf)
+			if err != nil {
+				log.Fatal("--as-of must be an RFC3339 timestamp, e.g. 2021-06-30T13:00:00Z")
+			}
+		}
+
 		cr := connect_backup.ConnectRestore{
 			ConnectInstanceId: pInstance,
 			Session:           *sess,
 			Source:            *pSource,
 			Element:           connect_backup.ConnectElement(*pType),
 			NewName:           *pCreate,
+			Mapping:           theMapping,
+			Snapshot:          snapshotWriter(*pSnapshotFile, *pSnapshotS3, sess),
+			RollbackOnFailure: *pRollback,
+			VersionId:         *pVersionId,
+			AsOf:              asOf,
+			BackupRoot:        *pBackupRoot,
+			Name:              *pName,
+			Include:           *pInclude,
+			Exclude:           *pExclude,
+			Parallelism:       *pParallel,
+			UpdateExisting:    *pUpdateExisting,
+			Credentials:       credentialStore(*pCredentialPublicKey, *pCredentialDir, *pCredentialSecretPrefix, sess),
+			Verify:            *pVerify,
+			Keys:              localKeys(*pRestoreKeyFile),
+		}
+		if *pSource == "-" {
+			cr.Reader = &connect_backup.StdinReader{}
+		}
+
+		if cr.IsBulk() {
+			if *pPlan || *pPlanFile != "" || *pCreate != "" {
+				app.FatalUsage("--plan, --plan-file and --create can't be used when restoring a directory or S3 prefix\n")
+			}
+
+			var results []connect_backup.RestoreResult
+			results, err = cr.RestoreAll()
+			if err != nil {
+				log.Fatal(err)
+			}
+			if failed := connect_backup.PrintSummary(results, os.Stdout); failed > 0 {
+				log.Fatalf("%d of %d %s failed to restore", failed, len(results), *pType)
+			}
+			break
+		}
+
+		if *pPlan || *pPlanFile != "" {
+			var thePlan *connect_backup.RestorePlan
+			thePlan, err = cr.Plan()
+			if err != nil {
+				log.Fatal(err)
+			}
+			thePlan.Print(os.Stdout)
+			if *pPlanFile != "" {
+				err = thePlan.Save(*pPlanFile)
+			}
+		} else {
+			err = cr.Restore()
+		}
+
+	case pApplyCommand.FullCommand():
+		if *pApplyRollback && *pApplySnapshotFile == "" && *pApplySnapshotS3 == nil {
+			app.FatalUsage("--rollback needs --snapshot-file or --snapshot-s3 to save the live element to\n")
+		}
+
+		var thePlan *connect_backup.RestorePlan
+		thePlan, err = connect_backup.LoadPlan(*pPlanSource)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		cr := connect_backup.ConnectRestore{
+			Session:           *sess,
+			Snapshot:          snapshotWriter(*pApplySnapshotFile, *pApplySnapshotS3, sess),
+			RollbackOnFailure: *pApplyRollback,
+			Credentials:       credentialStore(*pApplyCredentialPublicKey, *pApplyCredentialDir, *pApplyCredentialSecretPrefix, sess),
+			Keys:              localKeys(*pApplyKeyFile),
+		}
+		err = cr.Apply(*thePlan)
+
+	case pSyncCommand.FullCommand():
+
+		var theMapping *connect_backup.Mapping
+		if *pSyncMapping != "" {
+			theMapping, err = connect_backup.LoadMapping(*pSyncMapping)
+			if err != nil {
+				log.Fatal(err)
+			}
 		}
-		err = cr.Restore()
+
+		cr := connect_backup.ConnectRestore{
+			ConnectInstanceId: pInstance,
+			Session:           *sess,
+			Source:            *pSyncSource,
+			Mapping:           theMapping,
+			Snapshot:          snapshotWriter(*pSyncSnapshotFile, *pSyncSnapshotS3, sess),
+			Credentials:       credentialStore(*pSyncCredentialPublicKey, *pSyncCredentialDir, *pSyncCredentialSecretPrefix, sess),
+			Keys:              localKeys(*pSyncKeyFile),
+		}
+
+		var results []connect_backup.SyncResult
+		results, err = cr.Sync(*pSyncDelete)
+		if failed := connect_backup.PrintSyncSummary(results, os.Stdout); failed > 0 && err == nil {
+			log.Fatalf("%d elements failed to sync", failed)
+		}
+
+	case pCreateInstanceCommand.FullCommand():
+
+		var theMapping *connect_backup.Mapping
+		if *pCreateInstanceMapping != "" {
+			theMapping, err = connect_backup.LoadMapping(*pCreateInstanceMapping)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		cr := connect_backup.ConnectRestore{
+			Session:     *sess,
+			Source:      *pCreateInstanceSource,
+			Mapping:     theMapping,
+			Credentials: credentialStore(*pCreateInstanceCredentialPublicKey, *pCreateInstanceCredentialDir, *pCreateInstanceCredentialSecretPrefix, sess),
+			Keys:        localKeys(*pCreateInstanceKeyFile),
+		}
+
+		var results []connect_backup.SyncResult
+		theMapping, results, err = cr.CreateInstanceFromBackup(*pCreateInstanceAlias, *pCreateInstanceDirectoryId)
+		if theMapping != nil {
+			if saveErr := theMapping.Save(*pCreateInstanceIdMap); saveErr != nil {
+				log.Println("Could not write the id map: " + saveErr.Error())
+			} else {
+				log.Println("Wrote the id map to " + *pCreateInstanceIdMap)
+			}
+		}
+		if failed := connect_backup.PrintSyncSummary(results, os.Stdout); failed > 0 && err == nil {
+			log.Fatalf("%d elements failed to restore", failed)
+		}
+
+	case pSnapshotsCommand.FullCommand():
+		err = connect_backup.ListSnapshots(sess, *pSnapshotsSource, os.Stdout)
+
+	case pVerifyCommand.FullCommand():
+		var problems []connect_backup.BackupProblem
+		problems, err = connect_backup.VerifyBackup(sess, *pVerifySource, localKeys(*pVerifyKeyFile))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if found := connect_backup.PrintBackupProblems(problems, os.Stdout); found > 0 {
+			log.Fatalf("%d problems found in the backup at %s", found, *pVerifySource)
+		}
+
+	case pPruneCommand.FullCommand():
+		_, err = connect_backup.Prune(sess, *pPruneSource, s3Options, localKeys(*pPruneKeyFile), connect_backup.Retention{
+			Daily:   *pPruneDaily,
+			Weekly:  *pPruneWeekly,
+			Monthly: *pPruneMonthly,
+		}, *pPruneDryRun, os.Stdout)
+
+	case pVersionsCommand.FullCommand():
+		err = connect_backup.ListVersions(sess, *pVersionsSource, os.Stdout)
 
 	case pRenameFlowsCommand.FullCommand():
 		connectSvc := connect.New(sess)
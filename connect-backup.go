@@ -1,7 +1,9 @@
 package connect_backup
 
 import (
+	"errors"
 	"log"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 
@@ -9,14 +11,44 @@ import (
 )
 
 type ConnectBackup struct {
-	Svc             *connect.Connect
-	TheWriter       Writer
-	RawFlow         bool
+	Svc       *connect.Connect
+	TheWriter Writer
+	RawFlow   bool
+	//Snapshots writes each backup to a new <instance id>/<timestamp> snapshot rather than over the previous one
+	Snapshots bool
+	//Incremental only writes the elements which have changed since the last backup, if the writer can tell
+	Incremental bool
+	//Version is the version of the tool taking the backup, which is recorded in the manifest
+	Version string
+	//Format is the format the elements are written in, json if it isn't set
+	Format          Format
 	ConnectInstance connect.Instance
 }
 
+func (cb ConnectBackup) write(result interface{}) error {
+	return writeElement(cb.TheWriter, aws.StringValue(cb.ConnectInstance.Id), result)
+}
+
+func (cb ConnectBackup) writeList(name string, result interface{}) error {
+	return writeElementList(cb.TheWriter, aws.StringValue(cb.ConnectInstance.Id), name, result)
+}
+
+//writeFlowString writes the content of a flow or flow module by itself
+func (cb ConnectBackup) writeFlowString(flow interface{}) error {
+	switch flow.(type) {
+	case connect.ContactFlow:
+		theFlow := flow.(connect.ContactFlow)
+		return writeFlowString(cb.TheWriter, aws.StringValue(cb.ConnectInstance.Id), *theFlow.Name, aws.StringValue(theFlow.Id), *theFlow.Content)
+	case connect.ContactFlowModule:
+		theModule := flow.(connect.ContactFlowModule)
+		return writeFlowString(cb.TheWriter, aws.StringValue(cb.ConnectInstance.Id), *theModule.Name, aws.StringValue(theModule.Id), *theModule.Content)
+	}
+	return errors.New("unexpected flow type passed to writer")
+}
+
 func (cb ConnectBackup) backupFlowModules() error {
 	log.Println("Backing up Flow Modules")
+	var writeErr error
 	err := cb.Svc.ListContactFlowModulesPages(&connect.ListContactFlowModulesInput{
 		InstanceId: cb.ConnectInstance.Id,
 	}, func(output *connect.ListContactFlowModulesOutput, b bool) bool {
@@ -32,29 +64,35 @@ func (cb ConnectBackup) backupFlowModules() error {
 				continue
 			}
 
-			err = cb.TheWriter.write(*result.ContactFlowModule)
+			err = cb.write(*result.ContactFlowModule)
 
 			if err != nil {
-				log.Fatal("Failed to write flow module object to the destination")
+				writeErr = errors.New("could not write flow module " + *result.ContactFlowModule.Name + " to the destination: " + err.Error())
+				return false
 			}
 
 			if cb.RawFlow {
-				err = cb.TheWriter.writeFlowString(*result.ContactFlowModule.Name, *result.ContactFlowModule.Content)
+				err = cb.writeFlowString(*result.ContactFlowModule)
 
 				if err != nil {
-					log.Fatal("Failed to write flow module string to the destination")
+					writeErr = errors.New("could not write the content of flow module " + *result.ContactFlowModule.Name + " to the destination: " + err.Error())
+					return false
 				}
 			}
 
 		}
 		return true
 	})
+	if err == nil {
+		err = writeErr
+	}
 
 	return err
 }
 
 func (cb ConnectBackup) backupFlows() error {
 	log.Println("Backing up Flows")
+	var writeErr error
 	err := cb.Svc.ListContactFlowsPages(&connect.ListContactFlowsInput{
 		InstanceId: cb.ConnectInstance.Id,
 	}, func(output *connect.ListContactFlowsOutput, b bool) bool {
@@ -70,23 +108,28 @@ func (cb ConnectBackup) backupFlows() error {
 				continue
 			}
 
-			err = cb.TheWriter.write(*result.ContactFlow)
+			err = cb.write(*result.ContactFlow)
 
 			if err != nil {
-				log.Fatal("Failed to write flow object to the destination")
+				writeErr = errors.New("could not write flow " + *result.ContactFlow.Name + " to the destination: " + err.Error())
+				return false
 			}
 
 			if cb.RawFlow {
-				err = cb.TheWriter.writeFlowString(*result.ContactFlow.Name, *result.ContactFlow.Content)
+				err = cb.writeFlowString(*result.ContactFlow)
 
 				if err != nil {
-					log.Fatal("Failed to write flow string to the destination")
+					writeErr = errors.New("could not write the content of flow " + *result.ContactFlow.Name + " to the destination: " + err.Error())
+					return false
 				}
 			}
 
 		}
 		return true
 	})
+	if err == nil {
+		err = writeErr
+	}
 
 	return err
 }
@@ -94,8 +137,15 @@ func (cb ConnectBackup) backupFlows() error {
 func (cb ConnectBackup) BackupFlowByName(name string) error {
 
 	log.Println("Backing up Flow " + name)
+	err := cb.TheWriter.Init(*cb.ConnectInstance.Id)
+	if err != nil {
+		return err
+	}
+	cb.TheWriter = cb.formatWriter(cb.TheWriter)
+
 	foundFlow := false
-	err := cb.Svc.ListContactFlowsPages(&connect.ListContactFlowsInput{
+	var writeErr error
+	err = cb.Svc.ListContactFlowsPages(&connect.ListContactFlowsInput{
 		InstanceId: cb.ConnectInstance.Id,
 	}, func(output *connect.ListContactFlowsOutput, b bool) bool {
 		for _, v := range output.ContactFlowSummaryList {
@@ -114,23 +164,28 @@ func (cb ConnectBackup) BackupFlowByName(name string) error {
 				return true
 			}
 
-			err = cb.TheWriter.write(*result.ContactFlow)
+			err = cb.write(*result.ContactFlow)
 
 			if err != nil {
-				log.Fatal("Failed to write flow object to the destination")
+				writeErr = errors.New("could not write flow " + *result.ContactFlow.Name + " to the destination: " + err.Error())
+				return false
 			}
 
 			if cb.RawFlow {
-				err = cb.TheWriter.writeFlowString(*result.ContactFlow.Name, *result.ContactFlow.Content)
+				err = cb.writeFlowString(*result.ContactFlow)
 
 				if err != nil {
-					log.Fatal("Failed to write flow string to the destination")
+					writeErr = errors.New("could not write the content of flow " + *result.ContactFlow.Name + " to the destination: " + err.Error())
+					return false
 				}
 			}
 
 		}
 		return true
 	})
+	if err == nil {
+		err = writeErr
+	}
 	if !foundFlow {
 		log.Println("Did not find a contact flow named " + name)
 	}
@@ -139,6 +194,7 @@ func (cb ConnectBackup) BackupFlowByName(name string) error {
 
 func (cb ConnectBackup) backupUsers() error {
 	log.Println("Backing up Users")
+	var writeErr error
 	err := cb.Svc.ListUsersPages(&connect.ListUsersInput{
 		InstanceId: cb.ConnectInstance.Id,
 	}, func(output *connect.ListUsersOutput, b bool) bool {
@@ -153,21 +209,26 @@ func (cb ConnectBackup) backupUsers() error {
 				log.Println("Failed to describe user " + (*v).String())
 				return true
 			}
-			err = cb.TheWriter.write(*result.User)
+			err = cb.write(*result.User)
 
 			if err != nil {
-				log.Fatal("Failed to write to the destination")
+				writeErr = errors.New("could not write user " + *result.User.Username + " to the destination: " + err.Error())
+				return false
 			}
 
 		}
 		return true
 	})
+	if err == nil {
+		err = writeErr
+	}
 
 	return err
 }
 
 func (cb ConnectBackup) backupUserHierarchyGroups() error {
 	log.Println("Backing up user Hierarchy Groups")
+	var writeErr error
 	err := cb.Svc.ListUserHierarchyGroupsPages(&connect.ListUserHierarchyGroupsInput{
 		InstanceId: cb.ConnectInstance.Id,
 	}, func(output *connect.ListUserHierarchyGroupsOutput, b bool) bool {
@@ -183,15 +244,19 @@ func (cb ConnectBackup) backupUserHierarchyGroups() error {
 				log.Println("Failed to describe user hierarchy group " + (*v).String())
 				return true
 			}
-			err = cb.TheWriter.write(*result.HierarchyGroup)
+			err = cb.write(*result.HierarchyGroup)
 
 			if err != nil {
-				log.Fatal("Failed to write to the destination")
+				writeErr = errors.New("could not write user hierarchy group " + *result.HierarchyGroup.Name + " to the destination: " + err.Error())
+				return false
 			}
 
 		}
 		return true
 	})
+	if err == nil {
+		err = writeErr
+	}
 	return err
 }
 
@@ -206,12 +271,13 @@ func (cb ConnectBackup) backupUserHierarchyStructure() error {
 		log.Println("Failed to describe user hierarchy structure")
 		return err
 	}
-	return cb.TheWriter.write(*result.HierarchyStructure)
+	return cb.write(*result.HierarchyStructure)
 
 }
 
 func (cb ConnectBackup) backupRoutingProfile() error {
 	log.Println("Backing up Routing Profiles")
+	var writeErr error
 	err := cb.Svc.ListRoutingProfilesPages(&connect.ListRoutingProfilesInput{
 		InstanceId: cb.ConnectInstance.Id,
 	}, func(output *connect.ListRoutingProfilesOutput, b bool) bool {
@@ -225,23 +291,29 @@ func (cb ConnectBackup) backupRoutingProfile() error {
 
 			if err != nil {
 				log.Println("Failed to describe user routing profile")
+				continue
 			}
 
-			err = cb.TheWriter.write(*result.RoutingProfile)
+			err = cb.write(*result.RoutingProfile)
 
 			if err != nil {
-				log.Println("Failed to write to the destination")
+				writeErr = errors.New("could not write routing profile " + *result.RoutingProfile.Name + " to the destination: " + err.Error())
+				return false
 			}
 
 			err = cb.backupRoutingProfileQueues(*result.RoutingProfile.RoutingProfileId)
 
 			if err != nil {
-				log.Println("Failed to backup Routing Profile Queues " + *result.RoutingProfile.RoutingProfileId)
+				writeErr = errors.New("could not back up the queues of routing profile " + *result.RoutingProfile.Name + ": " + err.Error())
+				return false
 			}
 
 		}
 		return true
 	})
+	if err == nil {
+		err = writeErr
+	}
 
 	return err
 }
@@ -253,13 +325,17 @@ type backupRoutingProfileQueueSummary struct {
 
 func (cb ConnectBackup) backupRoutingProfileQueues(routingProfileId string) error {
 	log.Println("Backing up Routing Profile Queues")
+	var writeErr error
 	err := cb.Svc.ListRoutingProfileQueuesPages(&connect.ListRoutingProfileQueuesInput{
 		InstanceId:       cb.ConnectInstance.Id,
 		RoutingProfileId: aws.String(routingProfileId),
 	}, func(output *connect.ListRoutingProfileQueuesOutput, b bool) bool {
-		_ = cb.TheWriter.writeList(routingProfileId, output.RoutingProfileQueueConfigSummaryList)
-		return true
+		writeErr = cb.writeList(routingProfileId, output.RoutingProfileQueueConfigSummaryList)
+		return writeErr == nil
 	})
+	if err == nil {
+		err = writeErr
+	}
 
 	return err
 }
@@ -270,14 +346,17 @@ func (cb ConnectBackup) backupPrompts() error {
 		InstanceId: cb.ConnectInstance.Id,
 	})
 
-	_ = cb.TheWriter.writeList(string(Prompts), result.PromptSummaryList)
-	return err
+	if err != nil {
+		return err
+	}
+	return cb.writeList(string(Prompts), result.PromptSummaryList)
 
 }
 
 func (cb ConnectBackup) backupHours() error {
 	log.Println("Backing up Hours")
 
+	var writeErr error
 	err := cb.Svc.ListHoursOfOperationsPages(&connect.ListHoursOfOperationsInput{
 		InstanceId: cb.ConnectInstance.Id,
 	}, func(output *connect.ListHoursOfOperationsOutput, b bool) bool {
@@ -293,16 +372,18 @@ func (cb ConnectBackup) backupHours() error {
 				return true
 			}
 
-			err = cb.TheWriter.write(*result.HoursOfOperation)
+			err = cb.write(*result.HoursOfOperation)
 
 			if err != nil {
-				log.Println(err)
-				log.Fatal("Failed to write to the destination")
-
+				writeErr = errors.New("could not write hours of operation " + *result.HoursOfOperation.Name + " to the destination: " + err.Error())
+				return false
 			}
 		}
 		return true
 	})
+	if err == nil {
+		err = writeErr
+	}
 	return err
 }
 
@@ -318,8 +399,10 @@ func (cb ConnectBackup) backupQuickConnects() error {
 		return true
 	})
 
-	_ = cb.TheWriter.write(allOutputs)
-	return err
+	if err != nil {
+		return err
+	}
+	return cb.write(allOutputs)
 }
 
 func (cb ConnectBackup) backupLambdas() error {
@@ -334,8 +417,10 @@ func (cb ConnectBackup) backupLambdas() error {
 		return true
 	})
 
-	_ = cb.TheWriter.write(allOutputs)
-	return err
+	if err != nil {
+		return err
+	}
+	return cb.write(allOutputs)
 }
 
 func (cb ConnectBackup) backupLex() error {
@@ -350,13 +435,16 @@ func (cb ConnectBackup) backupLex() error {
 		return true
 	})
 
-	_ = cb.TheWriter.write(allOutputs)
-	return err
+	if err != nil {
+		return err
+	}
+	return cb.write(allOutputs)
 }
 
 func (cb ConnectBackup) backupQueues() error {
 	log.Println("Backing up Queue")
 
+	var writeErr error
 	err := cb.Svc.ListQueuesPages(&connect.ListQueuesInput{
 		InstanceId: cb.ConnectInstance.Id,
 	}, func(output *connect.ListQueuesOutput, b bool) bool {
@@ -373,11 +461,18 @@ func (cb ConnectBackup) backupQueues() error {
 					continue
 				}
 
-				err = cb.TheWriter.write(*result.Queue)
+				err = cb.write(*result.Queue)
+				if err != nil {
+					writeErr = errors.New("could not write queue " + *result.Queue.Name + " to the destination: " + err.Error())
+					return false
+				}
 			}
 		}
 		return true
 	})
+	if err == nil {
+		err = writeErr
+	}
 	return err
 }
 
@@ -393,7 +488,7 @@ func (cb ConnectBackup) backupInstance() error {
 		return err
 	}
 
-	err = cb.TheWriter.write(*result.Instance)
+	err = cb.write(*result.Instance)
 
 	return err
 }
@@ -416,91 +511,215 @@ func (cb ConnectBackup) backupInstanceAttributes() error {
 		return err
 	}
 
-	err = cb.TheWriter.write(allOutputs)
+	err = cb.write(allOutputs)
 
 	return err
 }
 
-func (cb ConnectBackup) backupItems() {
+func (cb ConnectBackup) backupStorageConfigs() error {
+	log.Println("Backing up Instance Storage Configs")
 
+	allOutputs := make(instanceStorageConfigs)
+	for _, resourceType := range connect.InstanceStorageResourceType_Values() {
+		err := cb.Svc.ListInstanceStorageConfigsPages(&connect.ListInstanceStorageConfigsInput{
+			InstanceId:   cb.ConnectInstance.Id,
+			ResourceType: aws.String(resourceType),
+		}, func(output *connect.ListInstanceStorageConfigsOutput, b bool) bool {
+			allOutputs[resourceType] = append(allOutputs[resourceType], output.StorageConfigs...)
+			return true
+		})
+
+		if err != nil {
+			log.Println("error Listing Instance Storage Configs " + resourceType + " " + *cb.ConnectInstance.Id)
+			return err
+		}
+	}
+
+	return cb.write(allOutputs)
+}
+
+//backupItems backs up everything in the instance, carrying on past failures, and returns the parts that failed
+func (cb ConnectBackup) backupItems() []string {
+
+	var failed []string
 	var err error
 	err = cb.backupInstanceAttributes()
 	if err != nil {
 		log.Print("Error backing up Instance Attributes")
 		log.Println(err)
+		failed = append(failed, "Instance Attributes: "+err.Error())
+	}
+	err = cb.backupStorageConfigs()
+	if err != nil {
+		log.Print("Error backing up Instance Storage Configs")
+		log.Println(err)
+		failed = append(failed, "Instance Storage Configs: "+err.Error())
 	}
 	err = cb.backupInstance()
 	if err != nil {
 		log.Print("Error backing up Instance")
 		log.Println(err)
+		failed = append(failed, "Instance: "+err.Error())
 	}
 	err = cb.backupLambdas()
 	if err != nil {
 		log.Print("Error backing up Lambdas")
 		log.Println(err)
+		failed = append(failed, "Lambdas: "+err.Error())
 	}
 	err = cb.backupLex()
 	if err != nil {
 		log.Print("Error backing up Lex Bots")
 		log.Println(err)
+		failed = append(failed, "Lex Bots: "+err.Error())
 	}
 	err = cb.backupPrompts()
 	if err != nil {
 		log.Print("Error backing up Prompts")
 		log.Println(err)
+		failed = append(failed, "Prompts: "+err.Error())
 	}
 	err = cb.backupHours()
 	if err != nil {
 		log.Print("Error backing up Operating Hours")
 		log.Println(err)
+		failed = append(failed, "Operating Hours: "+err.Error())
 	}
 	err = cb.backupQuickConnects()
 	if err != nil {
 		log.Print("Error backing up Quick Connects")
 		log.Println(err)
+		failed = append(failed, "Quick Connects: "+err.Error())
 	}
 	err = cb.backupFlows()
 	if err != nil {
 		log.Print("Error backing up Flows")
 		log.Println(err)
+		failed = append(failed, "Flows: "+err.Error())
 	}
 
 	err = cb.backupFlowModules()
 	if err != nil {
 		log.Print("Error backing up Flow Modules")
 		log.Println(err)
+		failed = append(failed, "Flow Modules: "+err.Error())
 	}
 
 	err = cb.backupUsers()
 	if err != nil {
 		log.Print("Error backing up Users")
 		log.Println(err)
+		failed = append(failed, "Users: "+err.Error())
 	}
 	err = cb.backupRoutingProfile()
 	if err != nil {
 		log.Print("Error backing up Routing Profiles")
 		log.Println(err)
+		failed = append(failed, "Routing Profiles: "+err.Error())
 	}
 	err = cb.backupUserHierarchyGroups()
 	if err != nil {
 		log.Print("Error backing up Hierarchy Groups")
 		log.Println(err)
+		failed = append(failed, "Hierarchy Groups: "+err.Error())
 	}
 	err = cb.backupUserHierarchyStructure()
 	if err != nil {
 		log.Print("Error backing up Hierarchy Structure")
 		log.Println(err)
+		failed = append(failed, "Hierarchy Structure: "+err.Error())
 	}
 	err = cb.backupQueues()
 	if err != nil {
 		log.Print("Error backing up Queues")
 		log.Println(err)
+		failed = append(failed, "Queues: "+err.Error())
+	}
+	return failed
+}
+
+//backupInstanceItems backs up the current instance.  With Snapshots set it is written to a new snapshot, which is
+//marked as the latest if everything was backed up.
+func (cb ConnectBackup) backupInstanceItems() error {
+
+	instance := *cb.ConnectInstance.Id
+	path := instance
+	snapshot := ""
+	if cb.Snapshots {
+		if cb.Incremental {
+			log.Println("Every snapshot is written in full, incremental backups only apply without snapshots")
+		}
+		snapshot = time.Now().UTC().Format(time.RFC3339)
+		path = instance + "/" + snapshot
+	}
+
+	err := cb.TheWriter.Init(path)
+	if err != nil {
+		return err
 	}
+
+	//the writer is wrapped to skip unchanged elements and record what is written, but the latest marker and manifest
+	//are written straight to it
+	destination := cb.TheWriter
+
+	var summary BackupSummary
+	if cb.Incremental && !cb.Snapshots {
+		if changeWriter, ok := changeWriter(destination); ok {
+			summary = make(BackupSummary)
+			cb.TheWriter = countingWriter{changeWriter, summary}
+		} else {
+			log.Println("The destination can't tell which elements have changed, every element is written")
+		}
+	}
+
+	manifest, manifestErr := cb.startManifest(destination, snapshot)
+	if manifestErr != nil {
+		log.Println("Could not write the manifest of " + instance + ": " + manifestErr.Error())
+	} else if manifest != nil {
+		cb.TheWriter = manifest
+	}
+	cb.TheWriter = cb.formatWriter(cb.TheWriter)
+
+	failed := cb.backupItems()
+
+	if recorder, ok := destination.(FinishRecorder); ok {
+		recorder.Finished(path, failed)
+	}
+
+	if manifest != nil && manifestErr == nil {
+		manifestErr = manifest.finish(failed)
+		if manifestErr != nil {
+			log.Println("Could not write the manifest of " + instance + ": " + manifestErr.Error())
+		}
+	}
+
+	if summary != nil {
+		log.Println("Backup of " + instance + " complete:")
+		summary.Print(log.Writer())
+	}
+
+	if !cb.Snapshots {
+		return nil
+	}
+
+	if len(failed) > 0 || manifestErr != nil {
+		log.Printf("%d parts of the backup failed, snapshot %s of %s is not marked as the latest\n", len(failed), snapshot, instance)
+		return nil
+	}
+
+	marker, ok := destination.(LatestMarker)
+	if !ok {
+		return nil
+	}
+	log.Println("Marking snapshot " + snapshot + " as the latest backup of " + instance)
+	return marker.MarkLatest(instance, snapshot)
 }
 
 func (cb ConnectBackup) Backup() error {
 
 	var err error = nil
+	//the error of an instance which couldn't be backed up, kept apart from that of listing the instances
+	var backupErr error
 
 	var found bool = false
 	if *cb.ConnectInstance.Id != "" {
@@ -509,8 +728,8 @@ func (cb ConnectBackup) Backup() error {
 			for _, v := range output.InstanceSummaryList {
 				if *cb.ConnectInstance.Id == *v.Id {
 					log.Println("Backing up instance " + *v.InstanceAlias + ", " + *v.Id)
-					err = cb.TheWriter.init(*cb.ConnectInstance.Id)
-					cb.backupItems()
+					cb.ConnectInstance.Arn = v.Arn
+					backupErr = cb.backupInstanceItems()
 					found = true
 				}
 			}
@@ -527,12 +746,19 @@ func (cb ConnectBackup) Backup() error {
 			for _, v := range output.InstanceSummaryList {
 				log.Println("Backing up instance " + *v.InstanceAlias + ", " + *v.Id)
 				cb.ConnectInstance.Id = v.Id
-				err = cb.TheWriter.init(*cb.ConnectInstance.Id)
-				cb.backupItems()
+				cb.ConnectInstance.Arn = v.Arn
+				instanceErr := cb.backupInstanceItems()
+				if instanceErr != nil {
+					log.Println("Could not back up instance " + *v.Id + ": " + instanceErr.Error())
+					backupErr = instanceErr
+				}
 			}
 			return true
 		})
 	}
+	if err == nil {
+		err = backupErr
+	}
 	return err
 }
 
@@ -1,5 +1,7 @@
 package connect_backup
 
+import "github.com/aws/aws-sdk-go/service/connect"
+
 var defaultFlows = map[string]bool{
 	"Sample inbound flow (first contact experience)": true,
 	"Default agent hold":                             true,
@@ -42,6 +44,27 @@ const (
 	Lambdas                ConnectElement = "lambdas"
 	LexBots                ConnectElement = "lex-bots"
 	Attributes             ConnectElement = "attributes"
+	StorageConfigs         ConnectElement = "storage-configs"
+	Manifest               ConnectElement = "manifest"
 )
 
 type lambdaStrings []*string
+
+//instanceStorageConfigs are the storage configs of an instance by resource type
+type instanceStorageConfigs map[string][]*connect.InstanceStorageConfig
+
+//elementDirs are the directories the elements of an instance are written to
+var elementDirs = map[ConnectElement]bool{
+	Flows:                true,
+	FlowModules:          true,
+	FlowsRaw:             true,
+	RoutingProfiles:      true,
+	RoutingProfileQueues: true,
+	Users:                true,
+	UserHierarchyGroups:  true,
+	Prompts:              true,
+	HoursOfOperation:     true,
+	QuickConnects:        true,
+	Queues:               true,
+	common:               true,
+}
@@ -0,0 +1,116 @@
+package connect_backup
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+//CredentialStore is somewhere the initial password of a user created by a restore is delivered to, so it can be handed
+//to the user rather than thrown away
+type CredentialStore interface {
+	store(username string, password string) error
+}
+
+//PublicKeyCredentialStore writes each password to <Directory>/<username>.password.enc, encrypted with RSA-OAEP (SHA-256)
+//for the RSA public key in the PEM file PublicKeyFile.  It is base64 encoded and can be decrypted with:
+//
+//	base64 -d alice.password.enc | openssl pkeyutl -decrypt -inkey private.pem -pkeyopt rsa_padding_mode:oaep -pkeyopt rsa_oaep_md:sha256
+type PublicKeyCredentialStore struct {
+	PublicKeyFile string
+	Directory     string
+}
+
+//SecretsManagerCredentialStore stores each username and password as a secret in AWS Secrets Manager named with the
+//Prefix followed by the username.  The secret is encrypted with KmsKeyId if one is given, otherwise the account's
+//default key.
+type SecretsManagerCredentialStore struct {
+	Sess     *session.Session
+	Prefix   string
+	KmsKeyId string
+}
+
+func (pk PublicKeyCredentialStore) store(username string, password string) error {
+
+	pemBytes, err := ioutil.ReadFile(pk.PublicKeyFile)
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return errors.New("no PEM data found in " + pk.PublicKeyFile)
+	}
+
+	var publicKey *rsa.PublicKey
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		publicKey, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		var key interface{}
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			if publicKey, ok = key.(*rsa.PublicKey); !ok {
+				err = errors.New("the public key in " + pk.PublicKeyFile + " is not an RSA key")
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, []byte(password), nil)
+	if err != nil {
+		return err
+	}
+
+	fileName := filepath.Join(pk.Directory, username+".password.enc")
+	return ioutil.WriteFile(fileName, []byte(base64.StdEncoding.EncodeToString(encrypted)+"\n"), 0600)
+}
+
+func (sm SecretsManagerCredentialStore) store(username string, password string) error {
+
+	secret, err := json.Marshal(map[string]string{
+		"username": username,
+		"password": password,
+	})
+	if err != nil {
+		return err
+	}
+
+	svc := secretsmanager.New(sm.Sess)
+
+	var kmsKeyId *string
+	if sm.KmsKeyId != "" {
+		kmsKeyId = aws.String(sm.KmsKeyId)
+	}
+
+	_, err = svc.CreateSecret(&secretsmanager.CreateSecretInput{
+		Name:         aws.String(sm.Prefix + username),
+		Description:  aws.String("Initial password for AWS Connect user " + username),
+		SecretString: aws.String(string(secret)),
+		KmsKeyId:     kmsKeyId,
+	})
+
+	//a user of the same name may have been created before, so replace their secret
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == secretsmanager.ErrCodeResourceExistsException {
+		_, err = svc.PutSecretValue(&secretsmanager.PutSecretValueInput{
+			SecretId:     aws.String(sm.Prefix + username),
+			SecretString: aws.String(string(secret)),
+		})
+	}
+	return err
+}
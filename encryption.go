@@ -0,0 +1,398 @@
+package connect_backup
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+//The Encryption of every encrypted document, which tells them apart from plain json elements
+const envelopeEncryption = "connect-backup/aes-256-gcm"
+
+//The size of the data keys and local keys, for AES-256
+const dataKeySize = 32
+
+//KeyWrapper creates the data keys elements are encrypted with, and wraps them so they can be stored alongside the
+//elements they encrypt
+type KeyWrapper interface {
+	//Provider names the wrapper in each encrypted document so its key can be unwrapped the same way
+	Provider() string
+	//DataKey returns a new data key, the wrapped copy to store and the id of the key it was wrapped with
+	DataKey() (key []byte, wrapped []byte, keyId string, err error)
+	//Unwrap returns the data key held in a wrapped copy returned by DataKey
+	Unwrap(wrapped []byte, keyId string) ([]byte, error)
+}
+
+//KMSKeys wraps data keys with a KMS key.  KeyId is only needed to create data keys, as KMS finds the key to unwrap
+//them with itself.
+type KMSKeys struct {
+	KeyId string
+	Sess  *session.Session
+}
+
+//LocalKeys wraps data keys with a key held in a local file, for use offline and in tests.  The file holds 32 random
+//bytes, base64 encoded, such as the output of openssl rand -base64 32.
+type LocalKeys struct {
+	KeyFile string
+}
+
+//encryptedDocument is what an encrypted element is written as in place of its json
+type encryptedDocument struct {
+	Encryption  string
+	KeyProvider string
+	KeyId       string
+	WrappedKey  []byte
+	Nonce       []byte
+	Ciphertext  []byte
+	//Element is the type and name of the element, which the ciphertext is bound to so it can't be swapped for another
+	//element's.  Documents encrypted before it was added have none.
+	Element string `json:",omitempty"`
+}
+
+//EncryptingWriter encrypts each element with AES-GCM before passing it on to the writer it wraps.  A single data key
+//is created for each EncryptingWriter and stored, wrapped, with every element it encrypts.
+type EncryptingWriter struct {
+	Writer
+	Keys KeyWrapper
+
+	lock     sync.Mutex
+	key      []byte
+	wrapped  []byte
+	keyId    string
+	existing *DecryptingReader
+}
+
+//sourceKey is the key the encrypted elements read by a DecryptingReader were encrypted with, empty if none were
+type sourceKey struct {
+	lock     sync.Mutex
+	provider string
+	keyId    string
+}
+
+//DecryptingReader decrypts the elements read through the reader it wraps.  Elements which aren't encrypted are passed
+//through unchanged.  Keys wrapped by KMS are unwrapped with Sess, and those wrapped by any other provider with Keys.
+type DecryptingReader struct {
+	Reader
+	Sess *session.Session
+	Keys KeyWrapper
+
+	//source, if set, records the key the elements read were encrypted with
+	source *sourceKey
+
+	lock sync.Mutex
+	keys map[string][]byte
+}
+
+func (KMSKeys) Provider() string {
+	return "kms"
+}
+
+func (kk KMSKeys) DataKey() ([]byte, []byte, string, error) {
+	result, err := kms.New(kk.Sess).GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:   aws.String(kk.KeyId),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, nil, "", errors.New("could not create a data key with " + kk.KeyId + ": " + err.Error())
+	}
+	return result.Plaintext, result.CiphertextBlob, aws.StringValue(result.KeyId), nil
+}
+
+func (kk KMSKeys) Unwrap(wrapped []byte, keyId string) ([]byte, error) {
+	result, err := kms.New(kk.Sess).Decrypt(&kms.DecryptInput{
+		CiphertextBlob: wrapped,
+	})
+	if err != nil {
+		return nil, errors.New("could not decrypt the data key with " + keyId + ": " + err.Error())
+	}
+	return result.Plaintext, nil
+}
+
+func (LocalKeys) Provider() string {
+	return "local"
+}
+
+//load reads the key from the file, along with an id for it which is the start of its sha256
+func (lk LocalKeys) load() ([]byte, string, error) {
+	encoded, err := ioutil.ReadFile(lk.KeyFile)
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(key) != dataKeySize {
+		return nil, "", errors.New("the key file " + lk.KeyFile + " must hold 32 bytes, base64 encoded")
+	}
+	sum := sha256.Sum256(key)
+	return key, hex.EncodeToString(sum[:8]), nil
+}
+
+func (lk LocalKeys) DataKey() ([]byte, []byte, string, error) {
+	localKey, keyId, err := lk.load()
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	key := make([]byte, dataKeySize)
+	_, err = io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	nonce, wrapped, err := seal(localKey, key, nil)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return key, append(nonce, wrapped...), keyId, nil
+}
+
+func (lk LocalKeys) Unwrap(wrapped []byte, keyId string) ([]byte, error) {
+	localKey, localId, err := lk.load()
+	if err != nil {
+		return nil, err
+	}
+	if localId != keyId {
+		return nil, errors.New("the element was encrypted with local key " + keyId + " but " + lk.KeyFile + " holds key " + localId)
+	}
+
+	gcm, err := newGCM(localKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, errors.New("the wrapped data key is too short")
+	}
+	return gcm.Open(nil, wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//seal encrypts the plaintext under the key with a random nonce, authenticating the additional data along with it
+func seal(key []byte, plaintext []byte, additionalData []byte) ([]byte, []byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nonce, gcm.Seal(nil, nonce, plaintext, additionalData), nil
+}
+
+//elementData is what an encrypted element is bound to, its type and name, whatever format it is written in
+func elementData(element Element) string {
+	element.Format = ""
+	return strings.TrimSuffix(element.Path("/"), jsonExtn)
+}
+
+//named is whether the element being read says which element it is.  An element read from standard input without a
+//name doesn't, so the element it was encrypted as can't be checked.
+func (e Element) named() bool {
+	return e.Name != "" || e.Type == Manifest || commonElements[e.Type]
+}
+
+//Init creates the data key the first time it is called, then initialises the writer it wraps
+func (ew *EncryptingWriter) Init(instance string) error {
+	ew.lock.Lock()
+	if ew.key == nil {
+		var err error
+		ew.key, ew.wrapped, ew.keyId, err = ew.Keys.DataKey()
+		if err != nil {
+			ew.lock.Unlock()
+			return err
+		}
+		ew.existing = &DecryptingReader{Keys: ew.Keys}
+	}
+	ew.lock.Unlock()
+	return ew.Writer.Init(instance)
+}
+
+func (ew *EncryptingWriter) Write(element Element, document []byte) error {
+	if ew.key == nil {
+		return errors.New("the encrypting writer must be initialised before it is written to")
+	}
+
+	nonce, ciphertext, err := seal(ew.key, document, []byte(elementData(element)))
+	if err != nil {
+		return err
+	}
+	encrypted, err := json.Marshal(encryptedDocument{
+		Encryption:  envelopeEncryption,
+		KeyProvider: ew.Keys.Provider(),
+		KeyId:       ew.keyId,
+		WrappedKey:  ew.wrapped,
+		Nonce:       nonce,
+		Ciphertext:  ciphertext,
+		Element:     elementData(element),
+	})
+	if err != nil {
+		return err
+	}
+	return ew.Writer.Write(element, encrypted)
+}
+
+//WriteIfChanged decrypts the element already written and compares it with the document, as the element is encrypted
+//differently every time it is written.  The writer it wraps must be able to read back what it has written.  An element
+//which can't be decrypted with the Keys is written again.
+func (ew *EncryptingWriter) WriteIfChanged(element Element, document []byte) (WriteResult, error) {
+	reader, ok := ew.Writer.(writtenReader)
+	if !ok {
+		return "", errors.New("the writer encrypted elements are passed to can't tell if they have changed")
+	}
+
+	existing, found, err := reader.readWritten(element)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return WriteNew, ew.Write(element, document)
+	}
+
+	plaintext, err := ew.existing.decrypt(element, existing)
+	if err == nil && bytes.Equal(plaintext, document) {
+		return WriteUnchanged, nil
+	}
+	return WriteChanged, ew.Write(element, document)
+}
+
+//MarkLatest marks the latest snapshot in the writer it wraps, if it can.  The marker only holds the snapshot name so
+//isn't encrypted.
+func (ew *EncryptingWriter) MarkLatest(instance string, snapshot string) error {
+	if marker, ok := ew.Writer.(LatestMarker); ok {
+		return marker.MarkLatest(instance, snapshot)
+	}
+	return nil
+}
+
+//Finished tells the writer it wraps how the backup ended, if it needs to know
+func (ew *EncryptingWriter) Finished(path string, failed []string) {
+	if recorder, ok := ew.Writer.(FinishRecorder); ok {
+		recorder.Finished(path, failed)
+	}
+}
+
+//Close closes the writer it wraps, if it needs closing
+func (ew *EncryptingWriter) Close() error {
+	if closer, ok := ew.Writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (dr *DecryptingReader) Read(element Element) ([]byte, error) {
+	document, err := dr.Reader.Read(element)
+	if err != nil {
+		return nil, err
+	}
+	return dr.decrypt(element, document)
+}
+
+//alongside finds the other elements written with the element through the reader it wraps, if it can
+func (dr *DecryptingReader) alongside(element Element) (Reader, error) {
+	versioned, ok := dr.Reader.(alongsideReader)
+	if !ok {
+		return dr, nil
+	}
+	reader, err := versioned.alongside(element)
+	if err != nil {
+		return nil, err
+	}
+	return &DecryptingReader{
+		Reader: reader,
+		Sess:   dr.Sess,
+		Keys:   dr.Keys,
+		source: dr.source,
+	}, nil
+}
+
+//decrypt returns the json held in an encrypted document, or the document itself if it isn't encrypted.  The document
+//must have been encrypted as the element being read.
+func (dr *DecryptingReader) decrypt(element Element, document []byte) ([]byte, error) {
+	var encrypted encryptedDocument
+	if json.Unmarshal(document, &encrypted) != nil || encrypted.Encryption != envelopeEncryption {
+		return document, nil
+	}
+	if encrypted.Element != "" && element.named() && encrypted.Element != elementData(element) {
+		return nil, errors.New("the element was encrypted as " + encrypted.Element + " not " + elementData(element))
+	}
+
+	key, err := dr.unwrap(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("the encrypted element has an invalid nonce")
+	}
+	var additionalData []byte
+	if encrypted.Element != "" {
+		additionalData = []byte(encrypted.Element)
+	}
+	plaintext, err := gcm.Open(nil, encrypted.Nonce, encrypted.Ciphertext, additionalData)
+	if err != nil {
+		return nil, errors.New("could not decrypt the element: " + err.Error())
+	}
+
+	if dr.source != nil {
+		dr.source.lock.Lock()
+		dr.source.provider, dr.source.keyId = encrypted.KeyProvider, encrypted.KeyId
+		dr.source.lock.Unlock()
+	}
+	return plaintext, nil
+}
+
+//unwrap returns the data key of an encrypted document.  Every element of a backup shares the same data key so it is
+//only unwrapped once.
+func (dr *DecryptingReader) unwrap(encrypted encryptedDocument) ([]byte, error) {
+	dr.lock.Lock()
+	defer dr.lock.Unlock()
+
+	cacheKey := encrypted.KeyProvider + "/" + string(encrypted.WrappedKey)
+	if key, ok := dr.keys[cacheKey]; ok {
+		return key, nil
+	}
+
+	var keys KeyWrapper
+	switch {
+	case dr.Keys != nil && dr.Keys.Provider() == encrypted.KeyProvider:
+		keys = dr.Keys
+	case encrypted.KeyProvider == KMSKeys{}.Provider():
+		keys = KMSKeys{Sess: dr.Sess}
+	default:
+		return nil, errors.New("the element was encrypted with a " + encrypted.KeyProvider + " key, which must be given to read it")
+	}
+
+	key, err := keys.Unwrap(encrypted.WrappedKey, encrypted.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	if dr.keys == nil {
+		dr.keys = make(map[string][]byte)
+	}
+	dr.keys[cacheKey] = key
+	return key, nil
+}
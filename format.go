@@ -0,0 +1,311 @@
+package connect_backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//Format is the format elements are written in
+type Format string
+
+const (
+	FormatJSON Format = "json"
+	FormatYAML Format = "yaml"
+)
+
+const yamlExtn = ".yaml"
+
+//The tag of a string holding json which has been expanded into yaml, so that it is turned back into a string when read
+const embeddedJSONTag = "!json"
+
+//extension is the file extension of elements written in the format, json if none is given
+func (f Format) extension() string {
+	if f == FormatYAML {
+		return yamlExtn
+	}
+	return jsonExtn
+}
+
+//splitFormat splits the extension from the file name of an element, returning the format it was written in
+func splitFormat(fileName string) (string, Format, bool) {
+	switch {
+	case strings.HasSuffix(fileName, jsonExtn):
+		return strings.TrimSuffix(fileName, jsonExtn), FormatJSON, true
+	case strings.HasSuffix(fileName, yamlExtn):
+		return strings.TrimSuffix(fileName, yamlExtn), FormatYAML, true
+	}
+	return fileName, "", false
+}
+
+//alternatives are the elements to try reading in turn.  An element read without a format can have been written in
+//either, json being tried first.
+func (e Element) alternatives() []Element {
+	if e.Format != "" || e.Type == Manifest {
+		return []Element{e}
+	}
+	jsonElement, yamlElement := e, e
+	jsonElement.Format, yamlElement.Format = FormatJSON, FormatYAML
+	return []Element{jsonElement, yamlElement}
+}
+
+//readAny reads the first of the alternatives of the element which can be read, returning the error reading the first
+//if none can
+func readAny(element Element, read func(Element) ([]byte, error)) ([]byte, error) {
+	var first error
+	for _, v := range element.alternatives() {
+		document, err := read(v)
+		if err == nil {
+			return document, nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return nil, first
+}
+
+//yamlWriter writes every element as yaml, apart from the manifest, before passing it on to the writer it wraps
+type yamlWriter struct {
+	Writer
+}
+
+//formatWriter wraps the writer so elements are written in the format of the backup
+func (cb ConnectBackup) formatWriter(w Writer) Writer {
+	if cb.Format == FormatYAML {
+		return yamlWriter{w}
+	}
+	return w
+}
+
+func (yw yamlWriter) Write(element Element, document []byte) error {
+	if element.Type == Manifest {
+		return yw.Writer.Write(element, document)
+	}
+
+	converted, err := jsonToYAML(document)
+	if err != nil {
+		return errors.New("could not write " + string(element.Type) + " " + element.Name + " as yaml: " + err.Error())
+	}
+	element.Format = FormatYAML
+	return yw.Writer.Write(element, converted)
+}
+
+func (yw yamlWriter) Location(element Element) (string, error) {
+	if element.Type != Manifest {
+		element.Format = FormatYAML
+	}
+	return yw.Writer.Location(element)
+}
+
+//jsonToYAML converts a json document to yaml, keeping the order of its fields and the exact text of its numbers.
+//Strings holding a json object, such as the content of a flow, are expanded into yaml as well.
+func jsonToYAML(document []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	node, err := jsonNode(decoder)
+	if err != nil {
+		return nil, err
+	}
+
+	var converted bytes.Buffer
+	encoder := yaml.NewEncoder(&converted)
+	encoder.SetIndent(2)
+	err = encoder.Encode(&yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{node}})
+	if err != nil {
+		return nil, err
+	}
+	err = encoder.Close()
+	return converted.Bytes(), err
+}
+
+//jsonNode reads the next json value from the decoder as a yaml node
+func jsonNode(decoder *json.Decoder) (*yaml.Node, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch value := token.(type) {
+	case json.Delim:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		if value == '{' {
+			node.Kind, node.Tag = yaml.MappingNode, "!!map"
+		}
+		for decoder.More() {
+			if node.Kind == yaml.MappingNode {
+				key, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key.(string)})
+			}
+			child, err := jsonNode(decoder)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, child)
+		}
+		//the closing delimiter
+		_, err = decoder.Token()
+		return node, err
+	case string:
+		return stringNode(value), nil
+	case json.Number:
+		if strings.ContainsAny(value.String(), ".eE") {
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: value.String()}, nil
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: value.String()}, nil
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(value)}, nil
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+}
+
+//stringNode returns a json string as a yaml node.  A string holding a json object is expanded, as long as it can be
+//turned back into exactly the same string.
+func stringNode(value string) *yaml.Node {
+	node := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+	if !strings.HasPrefix(value, "{") {
+		return node
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	expanded, err := jsonNode(decoder)
+	if err != nil || decoder.More() {
+		return node
+	}
+	var compact bytes.Buffer
+	if writeJSON(&compact, expanded) != nil || compact.String() != value {
+		return node
+	}
+	expanded.Tag = embeddedJSONTag
+	return expanded
+}
+
+//yamlToJSON converts a yaml document back into json, turning the json expanded by jsonToYAML back into strings
+func yamlToJSON(document []byte) ([]byte, error) {
+	var node yaml.Node
+	err := yaml.Unmarshal(document, &node)
+	if err != nil {
+		return nil, err
+	}
+	if node.Kind != yaml.DocumentNode || len(node.Content) == 0 {
+		return nil, errors.New("the yaml document is empty")
+	}
+
+	var converted bytes.Buffer
+	err = writeJSON(&converted, node.Content[0])
+	return converted.Bytes(), err
+}
+
+//writeJSON writes a yaml node as compact json
+func writeJSON(out *bytes.Buffer, node *yaml.Node) error {
+	if node.Kind == yaml.AliasNode {
+		return writeJSON(out, node.Alias)
+	}
+
+	if node.Tag == embeddedJSONTag {
+		var embedded bytes.Buffer
+		tag := node.Tag
+		node.Tag = ""
+		err := writeJSON(&embedded, node)
+		node.Tag = tag
+		if err != nil {
+			return err
+		}
+		return writeJSONString(out, embedded.String())
+	}
+
+	switch node.Kind {
+	case yaml.MappingNode, yaml.SequenceNode:
+		open, close := byte('['), byte(']')
+		if node.Kind == yaml.MappingNode {
+			open, close = '{', '}'
+		}
+		out.WriteByte(open)
+		for i, v := range node.Content {
+			if i > 0 {
+				if node.Kind == yaml.MappingNode && i%2 == 1 {
+					out.WriteByte(':')
+				} else {
+					out.WriteByte(',')
+				}
+			}
+			var err error
+			if node.Kind == yaml.MappingNode && i%2 == 0 {
+				err = writeJSONString(out, v.Value)
+			} else {
+				err = writeJSON(out, v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		out.WriteByte(close)
+		return nil
+	case yaml.ScalarNode:
+		return writeJSONScalar(out, node)
+	}
+	return errors.New("unexpected yaml at line " + strconv.Itoa(node.Line))
+}
+
+//writeJSONScalar writes a yaml scalar as the json value of the same type.  Numbers are written as they are in the yaml
+//wherever json allows, so they are read back exactly.
+func writeJSONScalar(out *bytes.Buffer, node *yaml.Node) error {
+	switch node.ShortTag() {
+	case "!!null":
+		out.WriteString("null")
+	case "!!bool":
+		var value bool
+		if err := node.Decode(&value); err != nil {
+			return err
+		}
+		out.WriteString(strconv.FormatBool(value))
+	case "!!int", "!!float":
+		var number json.Number
+		if json.Unmarshal([]byte(node.Value), &number) == nil {
+			out.WriteString(node.Value)
+			return nil
+		}
+		var value float64
+		if err := node.Decode(&value); err != nil {
+			return err
+		}
+		formatted, err := json.Marshal(value)
+		if err != nil {
+			return errors.New("the number " + node.Value + " at line " + strconv.Itoa(node.Line) + " can't be written as json")
+		}
+		out.Write(formatted)
+	default:
+		return writeJSONString(out, node.Value)
+	}
+	return nil
+}
+
+func writeJSONString(out io.Writer, value string) error {
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(value)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(bytes.TrimSuffix(encoded.Bytes(), []byte("\n")))
+	return err
+}
+
+//documentJSON returns the json of a document written in either format
+func documentJSON(document []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(document)
+	if len(trimmed) == 0 || trimmed[0] == '{' || trimmed[0] == '[' {
+		return document, nil
+	}
+	return yamlToJSON(document)
+}
@@ -0,0 +1,296 @@
+package connect_backup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//GitWriter writes a backup into the working tree of a git repository, laid out the same way as a FileWriter, and
+//commits it once the backup is done so git log shows the history of the instance.  The repository is created if it
+//doesn't exist, and the commit is pushed to Remote if it is set.  The backup is only committed once Close has been
+//called.
+type GitWriter struct {
+	Repository string
+	Remote     string
+	FileWriter
+
+	instance  string
+	instances []string
+	written   map[string]bool
+	complete  map[string]bool
+}
+
+//gitChanges are the names of the elements of each type a commit adds, modifies and deletes
+type gitChanges map[ConnectElement]map[string][]string
+
+//The element types named in the subject of each commit
+var gitSubjectTypes = []ConnectElement{Flows, Users, Queues}
+
+//git runs a git command in the repository, returning what it prints
+func (gw *GitWriter) git(input []byte, args ...string) ([]byte, error) {
+	command := args[0]
+	//commits are made as connect-backup unless git has been told who to commit as
+	if name, err := exec.Command("git", "-C", gw.Repository, "config", "user.name").Output(); err != nil || len(bytes.TrimSpace(name)) == 0 {
+		args = append([]string{"-c", "user.name=connect-backup", "-c", "user.email=connect-backup@localhost"}, args...)
+	}
+
+	cmd := exec.Command("git", append([]string{"-C", gw.Repository}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.New("git " + command + " failed in " + gw.Repository + ": " + strings.TrimSpace(stderr.String()) + " " + err.Error())
+	}
+	return output, nil
+}
+
+//Init creates the repository the first time it is called, then the directories of the instance within it
+func (gw *GitWriter) Init(instance string) error {
+	if gw.written == nil {
+		gw.written = make(map[string]bool)
+		gw.complete = make(map[string]bool)
+
+		err := os.MkdirAll(gw.Repository, 0744)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(gw.Repository, ".git")); os.IsNotExist(err) {
+			log.Println("Creating git repository " + gw.Repository)
+			_, err = gw.git(nil, "init", "-q")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	gw.BasePath = gw.Repository
+	gw.instance = instance
+	gw.instances = append(gw.instances, instance)
+	return gw.FileWriter.Init(instance)
+}
+
+//record notes the element was written, so it isn't removed as one deleted from the instance
+func (gw *GitWriter) record(element Element) {
+	gw.written[gw.instance+"/"+element.Path("/")] = true
+}
+
+//Write writes the element into the working tree.  Once the backup of the instance has finished without failures,
+//elements which weren't written are removed from it when it is committed.
+func (gw *GitWriter) Write(element Element, document []byte) error {
+	err := gw.FileWriter.Write(element, document)
+	if err != nil {
+		return err
+	}
+	gw.record(element)
+	return nil
+}
+
+//Finished records whether the backup of the instance finished without failures, as only then can the elements which
+//weren't written be taken to have been deleted from it
+func (gw *GitWriter) Finished(path string, failed []string) {
+	if gw.complete != nil {
+		gw.complete[path] = len(failed) == 0
+	}
+}
+
+//WriteIfChanged only writes the element into the working tree if it has changed, though git would see it hasn't
+func (gw *GitWriter) WriteIfChanged(element Element, document []byte) (WriteResult, error) {
+	result, err := gw.FileWriter.WriteIfChanged(element, document)
+	if err != nil {
+		return "", err
+	}
+	gw.record(element)
+	return result, nil
+}
+
+//readWritten reads back the element from the working tree.  It is only read to tell if it has changed, and one which
+//hasn't won't be written again, so it is recorded as written to keep it from being removed.
+func (gw *GitWriter) readWritten(element Element) ([]byte, bool, error) {
+	existing, found, err := gw.FileWriter.readWritten(element)
+	if err == nil {
+		gw.record(element)
+	}
+	return existing, found, err
+}
+
+//removeDeleted removes the elements of a complete backup of an instance which weren't written, as they have been
+//deleted from the instance since the last backup
+func (gw *GitWriter) removeDeleted(instance string) error {
+	for dir := range elementDirs {
+		files, err := ioutil.ReadDir(filepath.Join(gw.Repository, instance, string(dir)))
+		if err != nil {
+			continue
+		}
+		for _, v := range files {
+			path := instance + "/" + string(dir) + "/" + v.Name()
+			if _, _, ok := splitFormat(v.Name()); v.IsDir() || !ok || gw.written[path] {
+				continue
+			}
+			err = os.Remove(filepath.Join(gw.Repository, filepath.FromSlash(path)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//staged returns what the commit about to be made adds, modifies and deletes, along with the manifests it changes
+func (gw *GitWriter) staged() (gitChanges, []string, error) {
+	output, err := gw.git(nil, "diff", "--cached", "--name-status", "--no-renames", "-z")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changes := make(gitChanges)
+	var manifests []string
+	fields := strings.Split(strings.TrimSuffix(string(output), "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		path := fields[i+1]
+		if strings.HasSuffix(path, "/"+Element{Type: Manifest}.Path("/")) {
+			if fields[i] == "M" {
+				manifests = append(manifests, path)
+			}
+			continue
+		}
+
+		object, ok := parseBackupPath(path, "/")
+		if !ok {
+			continue
+		}
+		if object.element == common {
+			object.element = ConnectElement(object.name)
+		}
+
+		status := "modified"
+		switch fields[i] {
+		case "A":
+			status = "added"
+		case "D":
+			status = "deleted"
+		}
+		if changes[object.element] == nil {
+			changes[object.element] = make(map[string][]string)
+		}
+		changes[object.element][status] = append(changes[object.element][status], object.name)
+	}
+	return changes, manifests, nil
+}
+
+//count is how many elements of the types given changed, counting an element written as more than one type once
+func (changes gitChanges) count(types ...ConnectElement) int {
+	names := make(map[string]bool)
+	for _, element := range types {
+		for _, v := range changes[element] {
+			for _, name := range v {
+				names[name] = true
+			}
+		}
+	}
+	return len(names)
+}
+
+//message summarises the flows, users and queues changed in the subject, and lists every element changed in the body
+func (gw *GitWriter) message(changes gitChanges) string {
+	var instances []string
+	seen := make(map[string]bool)
+	for _, v := range gw.instances {
+		instance := strings.Split(v, "/")[0]
+		if !seen[instance] {
+			seen[instance] = true
+			instances = append(instances, instance)
+		}
+	}
+
+	var counts []string
+	for _, v := range gitSubjectTypes {
+		count := changes.count(v)
+		if v == Flows {
+			count = changes.count(Flows, FlowsRaw)
+		}
+		counts = append(counts, fmt.Sprintf("%d %s", count, v))
+	}
+	var message strings.Builder
+	fmt.Fprintf(&message, "Backup of %s: %s changed\n", strings.Join(instances, ", "), strings.Join(counts, ", "))
+
+	var types []string
+	for k := range changes {
+		types = append(types, string(k))
+	}
+	sort.Strings(types)
+	for _, v := range types {
+		fmt.Fprintf(&message, "\n%s:\n", v)
+		for _, status := range []string{"added", "modified", "deleted"} {
+			names := changes[ConnectElement(v)][status]
+			if len(names) == 0 {
+				continue
+			}
+			sort.Strings(names)
+			fmt.Fprintf(&message, "  %s: %s\n", status, strings.Join(names, ", "))
+		}
+	}
+	return message.String()
+}
+
+//Close commits the backup, unless nothing but the manifests has changed, and pushes it to the remote
+func (gw *GitWriter) Close() error {
+	if gw.written == nil {
+		return nil
+	}
+
+	for _, v := range gw.instances {
+		if !gw.complete[v] {
+			continue
+		}
+		err := gw.removeDeleted(v)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := gw.git(nil, "add", "-A")
+	if err != nil {
+		return err
+	}
+	changes, manifests, err := gw.staged()
+	if err != nil {
+		return err
+	}
+
+	if len(changes) == 0 {
+		log.Println("Nothing has changed since the last backup, no commit was made")
+		//the manifests only record when the backup ran, so are put back rather than left changed
+		if len(manifests) > 0 {
+			_, err = gw.git(nil, append([]string{"reset", "-q", "--"}, manifests...)...)
+			if err == nil {
+				_, err = gw.git(nil, append([]string{"checkout", "-q", "--"}, manifests...)...)
+			}
+		}
+		return err
+	}
+
+	message := gw.message(changes)
+	_, err = gw.git([]byte(message), "commit", "-q", "-F", "-")
+	if err != nil {
+		return err
+	}
+	log.Print("Committed " + strings.SplitN(message, "\n", 2)[0])
+
+	if gw.Remote == "" {
+		return nil
+	}
+	log.Println("Pushing the backup to " + gw.Remote)
+	_, err = gw.git(nil, "push", "-q", gw.Remote, "HEAD")
+	return err
+}
@@ -0,0 +1,94 @@
+package connect_backup
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+)
+
+//WriteResult is whether an element written by an incremental backup was new, changed or the same as the copy already
+//in the backup
+type WriteResult string
+
+const (
+	WriteNew       WriteResult = "new"
+	WriteChanged   WriteResult = "changed"
+	WriteUnchanged WriteResult = "unchanged"
+)
+
+//ChangeWriter is implemented by writers which can compare an element with the copy already written, so that unchanged
+//elements are not written again
+type ChangeWriter interface {
+	Writer
+	//WriteIfChanged writes the element unless the document is the same as the one already written
+	WriteIfChanged(element Element, document []byte) (WriteResult, error)
+}
+
+//writtenReader is implemented by writers which can read back an element they have written, so that a writer wrapping
+//them, which changes the document before passing it on, can still tell if it has changed
+type writtenReader interface {
+	//readWritten returns what was written for the element, false if it hasn't been written
+	readWritten(element Element) ([]byte, bool, error)
+}
+
+//changeWriter returns the writer as a ChangeWriter if it can tell which elements have changed.  An EncryptingWriter can
+//only tell if the writer it wraps can read back what it has written.
+func changeWriter(w Writer) (ChangeWriter, bool) {
+	if ew, ok := w.(*EncryptingWriter); ok {
+		if _, ok := ew.Writer.(writtenReader); !ok {
+			return nil, false
+		}
+	}
+	cw, ok := w.(ChangeWriter)
+	return cw, ok
+}
+
+//BackupSummary counts the elements of each type an incremental backup found to be new, changed and unchanged
+type BackupSummary map[ConnectElement]map[WriteResult]int
+
+//countingWriter only writes elements which have changed, counting what it finds
+type countingWriter struct {
+	ChangeWriter
+	summary BackupSummary
+}
+
+func (cw countingWriter) Write(element Element, document []byte) error {
+	result, err := cw.WriteIfChanged(element, document)
+	if err != nil {
+		return err
+	}
+	if cw.summary[element.Type] == nil {
+		cw.summary[element.Type] = make(map[WriteResult]int)
+	}
+	cw.summary[element.Type][result]++
+	return nil
+}
+
+//Print lists the counts for each type of element
+func (s BackupSummary) Print(out io.Writer) {
+	var types []string
+	for k := range s {
+		types = append(types, string(k))
+	}
+	sort.Strings(types)
+
+	for _, v := range types {
+		counts := s[ConnectElement(v)]
+		fmt.Fprintf(out, "%-25s %5d new  %5d changed  %5d unchanged\n", v, counts[WriteNew], counts[WriteChanged], counts[WriteUnchanged])
+	}
+}
+
+//documentHash is the hash of a document stored alongside it so it can be compared without reading it back
+func documentHash(document []byte) string {
+	sum := sha256.Sum256(document)
+	return hex.EncodeToString(sum[:])
+}
+
+//documentETag is the ETag S3 gives an object uploaded in a single part without KMS encryption
+func documentETag(document []byte) string {
+	sum := md5.Sum(document)
+	return "\"" + hex.EncodeToString(sum[:]) + "\""
+}
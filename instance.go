@@ -0,0 +1,305 @@
+package connect_backup
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/connect"
+)
+
+//How often to check if a new instance is ready and how long to wait for it
+const (
+	instancePollInterval = 15 * time.Second
+	instanceCreateWait   = 30 * time.Minute
+)
+
+//CreateInstanceFromBackup creates a new instance with the alias given, set up the same way as the instance in the
+//backup at Source, and then syncs the backed up elements into it.  DirectoryId is only needed when the backed up
+//instance used an existing directory.
+//
+//The returned Mapping holds every source to target id learnt along the way, along with anything in the restore's own
+//Mapping, and is returned even if some of the elements couldn't be restored.  Elements which aren't in the backup,
+//such as security profiles, must be mapped by the restore's Mapping for the users which refer to them to be restored.
+func (cr ConnectRestore) CreateInstanceFromBackup(alias string, directoryId string) (*Mapping, []SyncResult, error) {
+
+	objects, err := cr.listBackup(cr.Source)
+	if err != nil {
+		return nil, nil, errors.New("could not list " + cr.Source + ": " + err.Error())
+	}
+
+	backed := make(map[string]string)
+	instances := make(map[string]bool)
+	for _, v := range objects {
+		if v.element == common {
+			backed[v.name] = v.location
+			if v.name == string(Instance) {
+				instances[v.instance] = true
+			}
+		} else if v.element == Prompts {
+			backed[string(Prompts)] = v.location
+		}
+	}
+
+	if len(instances) > 1 {
+		return nil, nil, errors.New(cr.Source + " holds the backups of more than one instance, pass the instance directory instead")
+	}
+	if backed[string(Instance)] == "" {
+		return nil, nil, errors.New("no " + common + "/" + string(Instance) + jsonExtn + " found under " + cr.Source)
+	}
+
+	var sourceInstance connect.Instance
+	single := cr
+	single.Source = backed[string(Instance)]
+	err = single.readSource(&sourceInstance)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	connectSvc := connect.New(&cr.Session)
+	newInstance, err := cr.createInstance(connectSvc, sourceInstance, alias, directoryId)
+	if err != nil {
+		return nil, nil, err
+	}
+	cr.ConnectInstanceId = newInstance.Id
+
+	//Everything in the backup refers to the old instance, so start with the instance and account it is moving to
+	theMapping := &Mapping{
+		Arns:     make(map[string]string),
+		Ids:      make(map[string]string),
+		Names:    make(map[string]string),
+		Accounts: make(map[string]string),
+	}
+	if cr.Mapping != nil {
+		for k, v := range cr.Mapping.Arns {
+			theMapping.Arns[k] = v
+		}
+		for k, v := range cr.Mapping.Ids {
+			theMapping.Ids[k] = v
+		}
+		for k, v := range cr.Mapping.Names {
+			theMapping.Names[k] = v
+		}
+		for k, v := range cr.Mapping.Accounts {
+			theMapping.Accounts[k] = v
+		}
+	}
+	theMapping.learn(*sourceInstance.Id, *newInstance.Id)
+
+	sourceArn, err := arn.Parse(aws.StringValue(sourceInstance.Arn))
+	if err != nil {
+		return theMapping, nil, errors.New("could not parse the arn of the backed up instance: " + err.Error())
+	}
+	newArn, err := arn.Parse(aws.StringValue(newInstance.Arn))
+	if err != nil {
+		return theMapping, nil, errors.New("could not parse the arn of the new instance: " + err.Error())
+	}
+	if _, ok := theMapping.Accounts[sourceArn.AccountID]; !ok {
+		theMapping.Accounts[sourceArn.AccountID] = newArn.AccountID
+	}
+
+	//Settings which can't be applied are reported, but don't stop the elements being restored
+	var failures []string
+
+	if location := backed[string(Attributes)]; location != "" {
+		failures = append(failures, cr.restoreAttributes(connectSvc, location)...)
+	}
+	if location := backed[string(StorageConfigs)]; location != "" {
+		failures = append(failures, cr.restoreStorageConfigs(connectSvc, location)...)
+	}
+	if location := backed[string(Lambdas)]; location != "" {
+		failures = append(failures, cr.restoreLambdas(connectSvc, location, theMapping)...)
+	}
+	if location := backed[string(Prompts)]; location != "" {
+		failures = append(failures, cr.mapPrompts(connectSvc, location, theMapping)...)
+	}
+
+	cr.Mapping = theMapping
+	results, err := cr.Sync(false)
+	if err != nil {
+		return theMapping, results, err
+	}
+
+	if len(failures) > 0 {
+		return theMapping, results, errors.New("instance " + *newInstance.Id + " was created but could not be fully set up: " + strings.Join(failures, "; "))
+	}
+	return theMapping, results, nil
+}
+
+//createInstance creates an instance with the same identity management and calling settings as the source instance
+//and waits until it is active
+func (cr ConnectRestore) createInstance(connectSvc *connect.Connect, sourceInstance connect.Instance, alias string, directoryId string) (*connect.Instance, error) {
+
+	input := &connect.CreateInstanceInput{
+		IdentityManagementType: sourceInstance.IdentityManagementType,
+		InboundCallsEnabled:    sourceInstance.InboundCallsEnabled,
+		OutboundCallsEnabled:   sourceInstance.OutboundCallsEnabled,
+		InstanceAlias:          aws.String(alias),
+	}
+	if directoryId != "" {
+		input.DirectoryId = aws.String(directoryId)
+	} else if aws.StringValue(sourceInstance.IdentityManagementType) == connect.DirectoryTypeExistingDirectory {
+		return nil, errors.New("the backed up instance used an existing directory, the directory id for the new instance must be given")
+	}
+
+	log.Println("Creating instance " + alias)
+	result, err := connectSvc.CreateInstance(input)
+	if err != nil {
+		return nil, errors.New("could not create instance " + alias + ": " + err.Error())
+	}
+
+	deadline := time.Now().Add(instanceCreateWait)
+	for {
+		described, err := connectSvc.DescribeInstance(&connect.DescribeInstanceInput{
+			InstanceId: result.Id,
+		})
+		if err != nil {
+			return nil, errors.New("could not describe the new instance " + *result.Id + ": " + err.Error())
+		}
+
+		switch aws.StringValue(described.Instance.InstanceStatus) {
+		case connect.InstanceStatusActive:
+			log.Println("Instance " + alias + ", " + *result.Id + " is active")
+			return described.Instance, nil
+		case connect.InstanceStatusCreationFailed:
+			reason := "no reason given"
+			if described.Instance.StatusReason != nil {
+				reason = aws.StringValue(described.Instance.StatusReason.Message)
+			}
+			return nil, errors.New("creation of instance " + alias + ", " + *result.Id + " failed: " + reason)
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errors.New("instance " + alias + ", " + *result.Id + " was not active after " + instanceCreateWait.String())
+		}
+		log.Println("Waiting for instance " + alias + " to become active")
+		time.Sleep(instancePollInterval)
+	}
+}
+
+func (cr ConnectRestore) restoreAttributes(connectSvc *connect.Connect, location string) []string {
+	log.Println("Restoring Instance Attributes")
+
+	var attributes []*connect.Attribute
+	single := cr
+	single.Source = location
+	err := single.readSource(&attributes)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var failures []string
+	for _, v := range attributes {
+		_, err = connectSvc.UpdateInstanceAttribute(&connect.UpdateInstanceAttributeInput{
+			InstanceId:    cr.ConnectInstanceId,
+			AttributeType: v.AttributeType,
+			Value:         v.Value,
+		})
+		if err != nil {
+			failures = append(failures, "could not set attribute "+aws.StringValue(v.AttributeType)+": "+err.Error())
+		}
+	}
+	return failures
+}
+
+//restoreStorageConfigs associates the same S3 buckets, Kinesis streams and Firehoses with the new instance.  They are
+//outside of the instance so are used as they are.
+func (cr ConnectRestore) restoreStorageConfigs(connectSvc *connect.Connect, location string) []string {
+	log.Println("Restoring Instance Storage Configs")
+
+	configs := make(instanceStorageConfigs)
+	single := cr
+	single.Source = location
+	err := single.readSource(&configs)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var failures []string
+	for resourceType, v := range configs {
+		for _, config := range v {
+			config.AssociationId = nil
+			_, err = connectSvc.AssociateInstanceStorageConfig(&connect.AssociateInstanceStorageConfigInput{
+				InstanceId:    cr.ConnectInstanceId,
+				ResourceType:  aws.String(resourceType),
+				StorageConfig: config,
+			})
+			if err != nil {
+				failures = append(failures, "could not associate the "+resourceType+" storage config: "+err.Error())
+			}
+		}
+	}
+	return failures
+}
+
+//restoreLambdas associates the same lambda functions with the new instance.  Unless they are mapped to other functions,
+//flows keep calling the functions they did before.
+func (cr ConnectRestore) restoreLambdas(connectSvc *connect.Connect, location string, theMapping *Mapping) []string {
+	log.Println("Restoring Lambdas")
+
+	var lambdas []*string
+	single := cr
+	single.Source = location
+	err := single.readSource(&lambdas)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var failures []string
+	for _, v := range lambdas {
+		functionArn := *v
+		if mapped, ok := theMapping.Arns[functionArn]; ok {
+			functionArn = mapped
+		} else {
+			theMapping.Arns[functionArn] = functionArn
+		}
+
+		_, err = connectSvc.AssociateLambdaFunction(&connect.AssociateLambdaFunctionInput{
+			InstanceId:  cr.ConnectInstanceId,
+			FunctionArn: aws.String(functionArn),
+		})
+		if err != nil {
+			failures = append(failures, "could not associate lambda "+functionArn+": "+err.Error())
+		}
+	}
+	return failures
+}
+
+//mapPrompts maps the prompts in the backup to the prompts of the same name in the new instance.  Prompts can't be
+//created through the AWS API, so any others have to be uploaded and added to the mapping by hand.
+func (cr ConnectRestore) mapPrompts(connectSvc *connect.Connect, location string, theMapping *Mapping) []string {
+
+	var prompts []*connect.PromptSummary
+	single := cr
+	single.Source = location
+	err := single.readSource(&prompts)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	live := make(map[string]string)
+	err = connectSvc.ListPromptsPages(&connect.ListPromptsInput{
+		InstanceId: cr.ConnectInstanceId,
+	}, func(output *connect.ListPromptsOutput, b bool) bool {
+		for _, v := range output.PromptSummaryList {
+			live[*v.Name] = *v.Id
+		}
+		return true
+	})
+	if err != nil {
+		return []string{"could not list the prompts of the new instance: " + err.Error()}
+	}
+
+	var failures []string
+	for _, v := range prompts {
+		if id, ok := live[*v.Name]; ok {
+			theMapping.learn(*v.Id, id)
+		} else if _, ok := theMapping.Ids[*v.Id]; !ok {
+			failures = append(failures, "prompt "+*v.Name+" is not in the new instance and must be uploaded")
+		}
+	}
+	return failures
+}
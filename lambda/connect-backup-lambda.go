@@ -12,6 +12,8 @@ import (
 	"github.com/sethkor/connect-backup"
 )
 
+var version = "dev-local-version"
+
 type Response struct {
 	Answer string `json:"Response" yaml:"Response"`
 }
@@ -20,6 +22,52 @@ type Request struct {
 	ConnectInstanceId string `json:"ConnectInstanceId" yaml:"ConnectInstanceId"`
 	S3DestURL         string `json:"S3DestURL" yaml:"S3DestURL"`
 	FlowsRaw          *bool  `json:"FlowsRaw" yaml:"FlowsRaw"`
+	Snapshots         *bool  `json:"Snapshots" yaml:"Snapshots"`
+	Incremental       *bool  `json:"Incremental" yaml:"Incremental"`
+	KmsKeyId          string `json:"KmsKeyId" yaml:"KmsKeyId"`
+	KeepDaily         *int   `json:"KeepDaily" yaml:"KeepDaily"`
+	KeepWeekly        *int   `json:"KeepWeekly" yaml:"KeepWeekly"`
+	KeepMonthly       *int   `json:"KeepMonthly" yaml:"KeepMonthly"`
+	ObjectLockMode    string `json:"ObjectLockMode" yaml:"ObjectLockMode"`
+	ObjectLockDays    *int   `json:"ObjectLockDays" yaml:"ObjectLockDays"`
+	LegalHold         *bool  `json:"LegalHold" yaml:"LegalHold"`
+	Format            string `json:"Format" yaml:"Format"`
+}
+
+//boolOption takes an option from the event, or the environment variable if it isn't in the event, defaulting to false
+func boolOption(value *bool, envName string) bool {
+	if value != nil {
+		return *value
+	}
+
+	envString := os.Getenv(envName)
+	if envString == "" {
+		return false
+	}
+	parsed, err := strconv.ParseBool(envString)
+	if err != nil {
+		log.Println("The " + envName + " env variable was not a bool that can be parsed, I am setting this to false and continuing")
+		return false
+	}
+	return parsed
+}
+
+//intOption takes an option from the event, or the environment variable if it isn't in the event, defaulting to 0
+func intOption(value *int, envName string) int {
+	if value != nil {
+		return *value
+	}
+
+	envString := os.Getenv(envName)
+	if envString == "" {
+		return 0
+	}
+	parsed, err := strconv.Atoi(envString)
+	if err != nil {
+		log.Println("The " + envName + " env variable was not a number that can be parsed, I am setting this to 0 and continuing")
+		return 0
+	}
+	return parsed
 }
 
 func HandleRequest(ctx context.Context, backupRequest Request) (Response, error) {
@@ -77,6 +125,12 @@ func HandleRequest(ctx context.Context, backupRequest Request) (Response, error)
 	}
 	log.Println("FlowsRaw : " + strconv.FormatBool(flowsRaw))
 
+	snapshots := boolOption(backupRequest.Snapshots, "SNAPSHOTS")
+	log.Println("Snapshots : " + strconv.FormatBool(snapshots))
+
+	incremental := boolOption(backupRequest.Incremental, "INCREMENTAL")
+	log.Println("Incremental : " + strconv.FormatBool(incremental))
+
 	//connectSvc := connect.New(sess)
 	//result, err := connectSvc.DescribeInstance(&connect.DescribeInstanceInput{
 	//	InstanceId: &instanceId,
@@ -87,12 +141,54 @@ func HandleRequest(ctx context.Context, backupRequest Request) (Response, error)
 	//	return Response{Answer: "Could not fetch the instance specified"}, err
 	//}
 
+	format := backupRequest.Format
+	if format == "" {
+		format = os.Getenv("FORMAT")
+	}
+	if format != string(connect_backup.FormatYAML) {
+		if format != "" && format != string(connect_backup.FormatJSON) {
+			log.Println("The Format " + format + " is not json or yaml, I am writing json and continuing")
+		}
+		format = string(connect_backup.FormatJSON)
+	}
+	log.Println("Format : " + format)
+
+	//Objects are only locked if asked for, the bucket must have Object Lock enabled
+	s3Options := connect_backup.S3Options{
+		ObjectLockMode: backupRequest.ObjectLockMode,
+		ObjectLockDays: intOption(backupRequest.ObjectLockDays, "OBJECT_LOCK_DAYS"),
+		LegalHold:      boolOption(backupRequest.LegalHold, "LEGAL_HOLD"),
+	}
+	if s3Options.ObjectLockMode == "" {
+		s3Options.ObjectLockMode = os.Getenv("OBJECT_LOCK_MODE")
+	}
+	if s3Options.ObjectLockMode != "" || s3Options.LegalHold {
+		log.Printf("Object Lock : %s for %d days, legal hold %t", s3Options.ObjectLockMode, s3Options.ObjectLockDays, s3Options.LegalHold)
+	}
+
+	var theWriter connect_backup.Writer = &connect_backup.S3Writer{Destination: *s3Url, Sess: sess, Options: s3Options}
+	kmsKeyId := backupRequest.KmsKeyId
+	if kmsKeyId == "" {
+		kmsKeyId = os.Getenv("KMS_KEY_ID")
+	}
+	if kmsKeyId != "" {
+		log.Println("Encrypting with KMS key " + kmsKeyId)
+		theWriter = &connect_backup.EncryptingWriter{
+			Writer: theWriter,
+			Keys:   connect_backup.KMSKeys{KeyId: kmsKeyId, Sess: sess},
+		}
+	}
+
 	cb := connect_backup.ConnectBackup{ConnectInstance: connect.Instance{
 		Id: &instanceId,
 	},
-		Svc:       svc,
-		TheWriter: &connect_backup.S3Writer{Destination: *s3Url, Sess: sess},
-		RawFlow:   flowsRaw,
+		Svc:         svc,
+		TheWriter:   theWriter,
+		RawFlow:     flowsRaw,
+		Snapshots:   snapshots,
+		Incremental: incremental,
+		Version:     version,
+		Format:      connect_backup.Format(format),
 	}
 
 	err = cb.Backup()
@@ -102,6 +198,21 @@ func HandleRequest(ctx context.Context, backupRequest Request) (Response, error)
 		return Response{Answer: "There was an error performing the backup"}, err
 	}
 
+	//Old snapshots are only pruned once a new one has been taken, and only if some retention has been asked for
+	retention := connect_backup.Retention{
+		Daily:   intOption(backupRequest.KeepDaily, "KEEP_DAILY"),
+		Weekly:  intOption(backupRequest.KeepWeekly, "KEEP_WEEKLY"),
+		Monthly: intOption(backupRequest.KeepMonthly, "KEEP_MONTHLY"),
+	}
+	if snapshots && retention.Daily+retention.Weekly+retention.Monthly > 0 {
+		log.Printf("Pruning snapshots keeping %d daily, %d weekly and %d monthly", retention.Daily, retention.Weekly, retention.Monthly)
+		_, err = connect_backup.Prune(sess, s3Url.String(), s3Options, nil, retention, false, os.Stdout)
+		if err != nil {
+			log.Println("There was an error pruning the snapshots")
+			return Response{Answer: "There was an error pruning the snapshots"}, err
+		}
+	}
+
 	return Response{Answer: "Processing Successful"}, nil
 
 }
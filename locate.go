@@ -0,0 +1,336 @@
+package connect_backup
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//backupObject is a single element found under a backup root
+type backupObject struct {
+	location string
+	instance string
+	snapshot string
+	element  ConnectElement
+	name     string
+	format   Format
+}
+
+//The most suggestions given when a name can't be found
+const maxSuggestions = 5
+
+//listBackup finds every element under a local directory, S3 prefix or in an archive.  The root can be the directory
+//the backup was written to, or an instance directory within it.  Where an instance has been backed up into snapshots,
+//only the elements of its latest snapshot are returned.
+func (cr ConnectRestore) listBackup(root string) ([]backupObject, error) {
+	objects, markers, err := cr.listAll(root)
+	if err != nil {
+		return nil, err
+	}
+	return currentSnapshots(objects, markers), nil
+}
+
+//listAll finds every element under the root along with the latest snapshot marked for each instance
+func (cr ConnectRestore) listAll(root string) ([]backupObject, map[string]string, error) {
+
+	var objects []backupObject
+	markers := make(map[string]string)
+
+	if stdin, ok := cr.Reader.(*StdinReader); ok && root == "-" {
+		objects, err := stdin.objects()
+		return objects, markers, err
+	}
+
+	if isArchive(root) {
+		entries, err := readArchive(root, &cr.Session)
+		if err != nil {
+			return nil, nil, err
+		}
+		for name, v := range entries {
+			if path.Base(name) == latestMarker {
+				markers[path.Base(path.Dir(name))] = strings.TrimSpace(string(v))
+			} else if object, ok := parseBackupPath(name, "/"); ok {
+				object.location = root + archiveSeparator + name
+				objects = append(objects, object)
+			}
+		}
+		return objects, markers, nil
+	}
+
+	rootLocation, err := url.Parse(root)
+	if err == nil && rootLocation.Scheme == "s3" {
+		s3Svc := s3.New(&cr.Session)
+		var markerKeys []string
+		err = s3Svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+			Bucket: aws.String(rootLocation.Host),
+			Prefix: aws.String(s3Prefix(rootLocation.Path)),
+		}, func(output *s3.ListObjectsV2Output, b bool) bool {
+			for _, v := range output.Contents {
+				if strings.HasSuffix(*v.Key, "/"+latestMarker) {
+					markerKeys = append(markerKeys, *v.Key)
+				} else if object, ok := parseBackupPath(*v.Key, "/"); ok {
+					object.location = "s3://" + rootLocation.Host + "/" + *v.Key
+					objects = append(objects, object)
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, v := range markerKeys {
+			result, err := s3Svc.GetObject(&s3.GetObjectInput{
+				Bucket: aws.String(rootLocation.Host),
+				Key:    aws.String(v),
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			snapshot, err := ioutil.ReadAll(result.Body)
+			result.Body.Close()
+			if err != nil {
+				return nil, nil, err
+			}
+			markers[path.Base(path.Dir(v))] = strings.TrimSpace(string(snapshot))
+		}
+		return objects, markers, nil
+	}
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if info.Name() == latestMarker && info.Mode()&os.ModeSymlink != 0 {
+			snapshot, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			markers[filepath.Base(filepath.Dir(path))] = filepath.Base(snapshot)
+			return nil
+		}
+		if object, ok := parseBackupPath(path, string(os.PathSeparator)); ok {
+			object.location = path
+			objects = append(objects, object)
+		}
+		return nil
+	})
+	return objects, markers, err
+}
+
+//currentSnapshots leaves out the elements of every snapshot of an instance but the one marked as the latest, or the
+//most recent if the marked one isn't there
+func currentSnapshots(objects []backupObject, markers map[string]string) []backupObject {
+
+	found := make(map[string]bool)
+	newest := make(map[string]string)
+	for _, v := range objects {
+		if v.snapshot == "" {
+			continue
+		}
+		found[v.instance+"/"+v.snapshot] = true
+		if v.snapshot > newest[v.instance] {
+			newest[v.instance] = v.snapshot
+		}
+	}
+
+	current := make(map[string]string)
+	for instance, snapshot := range newest {
+		current[instance] = snapshot
+		if marked, ok := markers[instance]; ok && found[instance+"/"+marked] {
+			current[instance] = marked
+		}
+	}
+
+	var kept []backupObject
+	for _, v := range objects {
+		if v.snapshot == "" || v.snapshot == current[v.instance] {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+//s3Key is the key S3 stores an object under.  The SDK cleans the path of every request, so the leading slash of a URL
+//path and the empty segments S3Writer puts in its keys are dropped, and listings and version lookups have to match.
+func s3Key(key string) string {
+	return strings.TrimPrefix(path.Clean("/"+key), "/")
+}
+
+//s3Prefix is the prefix to list the objects under a directory with, keeping the trailing slash
+func s3Prefix(prefix string) string {
+	key := s3Key(prefix)
+	if key != "" && strings.HasSuffix(prefix, "/") {
+		key += "/"
+	}
+	return key
+}
+
+//parseBackupPath splits a path laid out by buildPrefix into its instance, element type and name.  Empty path segments
+//are ignored as S3 keys can contain them.
+func parseBackupPath(path string, separator string) (backupObject, bool) {
+
+	if _, _, ok := splitFormat(path); !ok {
+		return backupObject{}, false
+	}
+
+	var segments []string
+	for _, v := range strings.Split(path, separator) {
+		//leave out the snapshots taken before restores
+		if v == snapshotPrefix {
+			return backupObject{}, false
+		}
+		if v != "" {
+			segments = append(segments, v)
+		}
+	}
+	if len(segments) < 2 {
+		return backupObject{}, false
+	}
+
+	name, format, _ := splitFormat(segments[len(segments)-1])
+	object := backupObject{
+		element: ConnectElement(segments[len(segments)-2]),
+		name:    name,
+		format:  format,
+	}
+	//the manifest sits beside the elements of an instance rather than in a directory of elements
+	if object.name == string(Manifest) && !elementDirs[object.element] {
+		return backupObject{}, false
+	}
+	if len(segments) > 2 {
+		object.instance = segments[len(segments)-3]
+	}
+	//snapshots are written under a timestamp within the instance
+	if _, err := time.Parse(time.RFC3339, object.instance); err == nil && len(segments) > 3 {
+		object.snapshot = object.instance
+		object.instance = segments[len(segments)-4]
+	}
+	return object, true
+}
+
+//findSource finds the backup of the named element of the restore type under the backup root.  If the root holds more
+//than one instance, the backup of the instance being restored to is used.
+func (cr ConnectRestore) findSource() (string, error) {
+
+	objects, err := cr.listBackup(cr.BackupRoot)
+	if err != nil {
+		return "", errors.New("could not list the backup at " + cr.BackupRoot + ": " + err.Error())
+	}
+
+	var found []backupObject
+	var names []string
+	for _, v := range objects {
+		if v.element != cr.Element {
+			continue
+		}
+		if v.name == cr.Name {
+			found = append(found, v)
+		} else {
+			names = append(names, v.name)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		suggestions := suggest(cr.Name, names)
+		if len(suggestions) == 0 {
+			return "", errors.New("no " + string(cr.Element) + " named \"" + cr.Name + "\" found under " + cr.BackupRoot)
+		}
+		return "", errors.New("no " + string(cr.Element) + " named \"" + cr.Name + "\" found under " + cr.BackupRoot +
+			", did you mean \"" + strings.Join(suggestions, "\", \"") + "\"?")
+	case 1:
+		return found[0].location, nil
+	}
+
+	var instances []string
+	for _, v := range found {
+		if cr.ConnectInstanceId != nil && v.instance == *cr.ConnectInstanceId {
+			return v.location, nil
+		}
+		instances = append(instances, v.instance)
+	}
+	return "", errors.New("\"" + cr.Name + "\" was found in the backups of more than one instance (" + strings.Join(instances, ", ") +
+		"), pass the instance directory as the backup root")
+}
+
+//suggest returns the names closest to the one asked for, closest first
+func suggest(name string, names []string) []string {
+
+	type candidate struct {
+		name     string
+		distance int
+	}
+
+	seen := make(map[string]bool)
+	var candidates []candidate
+	lowerName := strings.ToLower(name)
+	for _, v := range names {
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+
+		lowerV := strings.ToLower(v)
+		distance := levenshtein(lowerName, lowerV)
+		if strings.Contains(lowerV, lowerName) || strings.Contains(lowerName, lowerV) || distance <= len(name)/3+1 {
+			candidates = append(candidates, candidate{v, distance})
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance == candidates[j].distance {
+			return candidates[i].name < candidates[j].name
+		}
+		return candidates[i].distance < candidates[j].distance
+	})
+
+	var suggestions []string
+	for i := 0; i < len(candidates) && i < maxSuggestions; i++ {
+		suggestions = append(suggestions, candidates[i].name)
+	}
+	return suggestions
+}
+
+func levenshtein(a string, b string) int {
+	first := []rune(a)
+	second := []rune(b)
+
+	previous := make([]int, len(second)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(first); i++ {
+		current := make([]int, len(second)+1)
+		current[0] = i
+		for j := 1; j <= len(second); j++ {
+			cost := 1
+			if first[i-1] == second[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(second)]
+}
+
+func min3(a int, b int, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
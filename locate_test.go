@@ -0,0 +1,116 @@
+package connect_backup
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestS3Key(t *testing.T) {
+	tests := []struct {
+		key    string
+		want   string
+		prefix string
+	}{
+		{"/backups/inst/queues/q.json", "backups/inst/queues/q.json", "backups/inst/queues/q.json"},
+		{"/backups//inst/queues/q.json", "backups/inst/queues/q.json", "backups/inst/queues/q.json"},
+		{"backups/inst/", "backups/inst", "backups/inst/"},
+		{"/backups/", "backups", "backups/"},
+		{"/", "", ""},
+		{"", "", ""},
+	}
+	for _, v := range tests {
+		if got := s3Key(v.key); got != v.want {
+			t.Errorf("s3Key(%q) = %q, want %q", v.key, got, v.want)
+		}
+		if got := s3Prefix(v.key); got != v.prefix {
+			t.Errorf("s3Prefix(%q) = %q, want %q", v.key, got, v.prefix)
+		}
+	}
+}
+
+//TestS3WriterKeysAreListed checks the keys a snapshot is written under are found by the listing of the root, with the
+//same instance and snapshot
+func TestS3WriterKeysAreListed(t *testing.T) {
+	for _, destination := range []string{"s3://bucket/backups", "s3://bucket/backups/", "s3://bucket"} {
+		location, err := url.Parse(destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//set up the way Init does, without the session Init needs to check Object Lock
+		s3w := &S3Writer{Destination: *location}
+		s3w.separator = "/"
+		s3w.path = s3w.Destination.Path + s3w.separator + "inst/2026-10-01T00:00:00Z" + s3w.separator
+		key := s3w.key(Element{Type: Queues, Name: "q"})
+
+		root, err := url.Parse(destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefix := s3Prefix(root.Path)
+		if len(key) < len(prefix) || key[:len(prefix)] != prefix {
+			t.Errorf("%s: key %q is not under the listed prefix %q", destination, key, prefix)
+		}
+
+		object, ok := parseBackupPath(key, "/")
+		if !ok {
+			t.Fatalf("%s: key %q is not a backup path", destination, key)
+		}
+		if object.instance != "inst" || object.snapshot != "2026-10-01T00:00:00Z" || object.element != Queues || object.name != "q" {
+			t.Errorf("%s: key %q was listed as %+v", destination, key, object)
+		}
+	}
+}
+
+func TestCurrentSnapshots(t *testing.T) {
+	objects := []backupObject{
+		{instance: "a", snapshot: "2026-10-01T00:00:00Z", name: "a1"},
+		{instance: "a", snapshot: "2026-10-02T00:00:00Z", name: "a2"},
+		{instance: "b", snapshot: "2026-10-01T00:00:00Z", name: "b1"},
+		{instance: "b", snapshot: "2026-10-02T00:00:00Z", name: "b2"},
+		{instance: "c", name: "c"},
+	}
+	markers := map[string]string{
+		//marked snapshot is used even though it isn't the newest
+		"a": "2026-10-01T00:00:00Z",
+		//a marked snapshot which isn't there falls back to the newest
+		"b": "2026-10-03T00:00:00Z",
+	}
+
+	var names []string
+	for _, v := range currentSnapshots(objects, markers) {
+		names = append(names, v.name)
+	}
+	want := []string{"a1", "b2", "c"}
+	if len(names) != len(want) {
+		t.Fatalf("currentSnapshots kept %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("currentSnapshots kept %v, want %v", names, want)
+		}
+	}
+}
+
+//TestS3ReaderKey checks an element is read from the key S3Writer wrote it to
+func TestS3ReaderKey(t *testing.T) {
+	for _, destination := range []string{"s3://bucket/backups", "s3://bucket/backups/", "s3://bucket"} {
+		location, err := url.Parse(destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s3w := &S3Writer{Destination: *location}
+		s3w.separator = "/"
+		s3w.path = s3w.Destination.Path + s3w.separator + "inst" + s3w.separator
+		element := Element{Type: Queues, Name: "q"}
+		written := s3w.key(element)
+
+		source, found, err := openSource("s3://bucket/"+written, nil, "", time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := source.(*S3Reader).key(found); got != written {
+			t.Errorf("%s: element written to %q is read from %q", destination, written, got)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package connect_backup
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+)
+
+//BackupManifest records what a backup of an instance wrote.  It is written as the backup starts and again once it is
+//done, so a manifest without a Finished time is from a backup which was cut off.
+type BackupManifest struct {
+	Version  string
+	Instance string
+	Snapshot string `json:",omitempty"`
+	Account  string `json:",omitempty"`
+	Region   string `json:",omitempty"`
+	Started  time.Time
+	Finished *time.Time `json:",omitempty"`
+	Elements []ManifestEntry
+	//Failed are the parts of the backup which failed, which will be missing some or all of their elements
+	Failed []string
+}
+
+//ManifestEntry is a single object written by a backup.  Path is where it is within the backup of the instance.
+type ManifestEntry struct {
+	Type   ConnectElement
+	Name   string
+	Id     string `json:",omitempty"`
+	Path   string
+	Sha256 string
+}
+
+//manifestWriter records every element written in the manifest, which it writes to the destination
+type manifestWriter struct {
+	Writer
+	destination Writer
+	manifest    *BackupManifest
+}
+
+func (mw manifestWriter) Write(element Element, document []byte) error {
+	err := mw.Writer.Write(element, document)
+	if err != nil {
+		return err
+	}
+
+	mw.manifest.Elements = append(mw.manifest.Elements, ManifestEntry{
+		Type:   element.Type,
+		Name:   element.Name,
+		Id:     element.Id,
+		Path:   element.Path("/"),
+		Sha256: documentHash(document),
+	})
+	return nil
+}
+
+func (mw manifestWriter) save() error {
+	document, err := json.MarshalIndent(mw.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return mw.destination.Write(Element{
+		Type:     Manifest,
+		Name:     string(Manifest),
+		Instance: mw.manifest.Instance,
+	}, document)
+}
+
+//finish records the parts that failed and when the backup finished, and writes the manifest again
+func (mw manifestWriter) finish(failed []string) error {
+	finished := time.Now().UTC()
+	mw.manifest.Finished = &finished
+	mw.manifest.Failed = failed
+	return mw.save()
+}
+
+//startManifest writes the manifest for the backup of the instance about to start, unless the destination can't be
+//restored from
+func (cb ConnectBackup) startManifest(destination Writer, snapshot string) (*manifestWriter, error) {
+
+	instance := aws.StringValue(cb.ConnectInstance.Id)
+	if _, err := destination.Location(Element{Type: Manifest, Name: string(Manifest), Instance: instance}); err != nil {
+		return nil, nil
+	}
+
+	manifest := &BackupManifest{
+		Version:  cb.Version,
+		Instance: instance,
+		Snapshot: snapshot,
+		Started:  time.Now().UTC(),
+		Elements: []ManifestEntry{},
+		Failed:   []string{},
+	}
+	if cb.Svc != nil {
+		manifest.Region = aws.StringValue(cb.Svc.Config.Region)
+	}
+	if instanceArn, err := arn.Parse(aws.StringValue(cb.ConnectInstance.Arn)); err == nil {
+		manifest.Account = instanceArn.AccountID
+	}
+
+	mw := &manifestWriter{
+		Writer:      cb.TheWriter,
+		destination: destination,
+		manifest:    manifest,
+	}
+	return mw, mw.save()
+}
@@ -0,0 +1,209 @@
+package connect_backup
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/private/protocol/json/jsonutil"
+	"gopkg.in/yaml.v3"
+)
+
+//Mapping holds the source to target substitutions used when restoring a backup into a different environment, e.g.
+//promoting from dev to prod.  It can be written as either YAML or JSON:
+//
+//	arns:
+//	  arn:aws:lambda:ap-southeast-2:111111111111:function:ivr-lookup-dev: arn:aws:lambda:ap-southeast-2:222222222222:function:ivr-lookup-prod
+//	ids:
+//	  946d3719-32f0-4ccc-a3de-713f52f6db7f: 1c5e2f7a-0d1b-4c53-8f3e-9a0b7d6c5e4f
+//	names:
+//	  Sales Dev: Sales
+//	accounts:
+//	  "111111111111": "222222222222"
+type Mapping struct {
+	Arns     map[string]string `json:"arns" yaml:"arns"`
+	Ids      map[string]string `json:"ids" yaml:"ids"`
+	Names    map[string]string `json:"names" yaml:"names"`
+	Accounts map[string]string `json:"accounts" yaml:"accounts"`
+}
+
+var (
+	arnPattern  = regexp.MustCompile(`arn:aws[a-z-]*:[a-z0-9-]+:[a-z0-9-]*:[0-9]{12}:[^"\s,}\]]+`)
+	uuidPattern = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+)
+
+//Flow content embeds its own block identifiers which are uuids, so only ARNs within it are treated as references
+const contentField = "Content"
+
+//Fields that are never restored and so don't need to be mapped
+var unmappedFields = map[string]bool{
+	"Tags": true,
+}
+
+//LoadMapping reads a YAML or JSON mapping file
+func LoadMapping(fileName string) (*Mapping, error) {
+	fileByte, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var theMapping Mapping
+	err = yaml.Unmarshal(fileByte, &theMapping)
+	if err != nil {
+		return nil, errors.New("could not parse mapping file " + fileName + ": " + err.Error())
+	}
+	return &theMapping, nil
+}
+
+//Save writes the mapping to a YAML file
+func (m *Mapping) Save(fileName string) error {
+	doc, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, doc, 0644)
+}
+
+//learn maps a source id to the id of the element it was restored to, unless it is already mapped
+func (m *Mapping) learn(sourceId string, targetId string) {
+	if m.Ids == nil {
+		m.Ids = make(map[string]string)
+	}
+	if _, ok := m.Ids[sourceId]; !ok {
+		m.Ids[sourceId] = targetId
+	}
+}
+
+//apply rewrites every reference in element, which must be a pointer to a connect type, using the mapping.  Fields
+//named in skip are left untouched and not checked, e.g. the elements own id when it is being created under a new name.
+//An error is returned listing every source reference which has no mapping.
+func (m *Mapping) apply(element interface{}, skip ...string) error {
+	doc, err := jsonutil.BuildJSON(element)
+	if err != nil {
+		return err
+	}
+
+	var tree interface{}
+	err = json.Unmarshal(doc, &tree)
+	if err != nil {
+		return err
+	}
+
+	skipFields := make(map[string]bool)
+	for _, v := range skip {
+		skipFields[v] = true
+	}
+
+	unmapped := make(map[string]bool)
+	tree = m.mapValue(tree, "", skipFields, unmapped)
+
+	if len(unmapped) > 0 {
+		var missing []string
+		for k := range unmapped {
+			missing = append(missing, k)
+		}
+		sort.Strings(missing)
+		return errors.New("no mapping found for source references: " + strings.Join(missing, ", "))
+	}
+
+	doc, err = json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(doc, element)
+}
+
+func (m *Mapping) mapValue(value interface{}, field string, skip map[string]bool, unmapped map[string]bool) interface{} {
+	switch value.(type) {
+	case map[string]interface{}:
+		for k, v := range value.(map[string]interface{}) {
+			if skip[k] || unmappedFields[k] {
+				continue
+			}
+			value.(map[string]interface{})[k] = m.mapValue(v, k, nil, unmapped)
+		}
+	case []interface{}:
+		for i, v := range value.([]interface{}) {
+			value.([]interface{})[i] = m.mapValue(v, field, nil, unmapped)
+		}
+	case string:
+		return m.mapString(value.(string), field == contentField, unmapped)
+	}
+	return value
+}
+
+func (m *Mapping) mapString(value string, arnsOnly bool, unmapped map[string]bool) string {
+
+	if mapped, ok := m.Names[value]; ok {
+		return mapped
+	}
+
+	//Map the ARNs first, then any ids which are left over once the ARNs are removed
+	var mappedArns []string
+	value = arnPattern.ReplaceAllStringFunc(value, func(source string) string {
+		mapped, ok := m.mapArn(source)
+		if !ok {
+			unmapped[source] = true
+		}
+		mappedArns = append(mappedArns, mapped)
+		return "\x00"
+	})
+
+	value = uuidPattern.ReplaceAllStringFunc(value, func(source string) string {
+		if mapped, ok := m.Ids[source]; ok {
+			return mapped
+		}
+		if !arnsOnly {
+			unmapped[source] = true
+		}
+		return source
+	})
+
+	for _, v := range mappedArns {
+		value = strings.Replace(value, "\x00", v, 1)
+	}
+	return value
+}
+
+//mapArn maps an ARN either by an exact match or by mapping each of its parts.  The account must be mapped, along with
+//every id in the resource.  Resources with no id, such as lambda functions, must have their name mapped.
+func (m *Mapping) mapArn(source string) (string, bool) {
+	if mapped, ok := m.Arns[source]; ok {
+		return mapped, true
+	}
+
+	parsed, err := arn.Parse(source)
+	if err != nil {
+		return source, false
+	}
+
+	found := true
+	if mapped, ok := m.Accounts[parsed.AccountID]; ok {
+		parsed.AccountID = mapped
+	} else {
+		found = false
+	}
+
+	if uuidPattern.MatchString(parsed.Resource) {
+		parsed.Resource = uuidPattern.ReplaceAllStringFunc(parsed.Resource, func(id string) string {
+			if mapped, ok := m.Ids[id]; ok {
+				return mapped
+			}
+			found = false
+			return id
+		})
+	} else {
+		i := strings.LastIndexAny(parsed.Resource, ":/")
+		if mapped, ok := m.Names[parsed.Resource[i+1:]]; ok {
+			parsed.Resource = parsed.Resource[:i+1] + mapped
+		} else {
+			found = false
+		}
+	}
+
+	return parsed.String(), found
+}
@@ -0,0 +1,129 @@
+package connect_backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+//ElementEnvelope is a single element printed by a StdoutWriter in NDJSON mode, one to a line.  Data is the json the
+//element is restored from, or the content of a raw flow.
+type ElementEnvelope struct {
+	Type     ConnectElement
+	Instance string
+	Name     string
+	Id       string `json:",omitempty"`
+	Data     json.RawMessage
+}
+
+//writeEnvelope writes the element as a single line of NDJSON
+func writeEnvelope(out io.Writer, element Element, document []byte) error {
+	var line bytes.Buffer
+	encoder := json.NewEncoder(&line)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(ElementEnvelope{
+		Type:     element.Type,
+		Instance: element.Instance,
+		Name:     element.Name,
+		Id:       element.Id,
+		Data:     document,
+	})
+	if err != nil {
+		return errors.New(string(element.Type) + " " + element.Name + " is not json so can't be written as NDJSON: " + err.Error())
+	}
+	_, err = out.Write(line.Bytes())
+	return err
+}
+
+//parseEnvelopes reads a stream of NDJSON written by a StdoutWriter, returning false if the input isn't one
+func parseEnvelopes(input []byte) ([]ElementEnvelope, bool) {
+	var envelopes []ElementEnvelope
+	for _, v := range bytes.Split(input, []byte("\n")) {
+		if len(bytes.TrimSpace(v)) == 0 {
+			continue
+		}
+		var envelope ElementEnvelope
+		if json.Unmarshal(v, &envelope) != nil || envelope.Type == "" || len(envelope.Data) == 0 {
+			return nil, false
+		}
+		envelopes = append(envelopes, envelope)
+	}
+	return envelopes, len(envelopes) > 0
+}
+
+//load reads standard input the first time it is called, working out if it is a stream of elements
+func (sr *StdinReader) load() error {
+	if sr.read {
+		return sr.err
+	}
+	sr.read = true
+
+	in := sr.In
+	if in == nil {
+		in = os.Stdin
+	}
+	sr.document, sr.err = ioutil.ReadAll(in)
+	if sr.err == nil {
+		sr.envelopes, sr.stream = parseEnvelopes(sr.document)
+	}
+	return sr.err
+}
+
+//isStream reports if standard input holds a stream of elements rather than a single one
+func (sr *StdinReader) isStream() bool {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	return sr.load() == nil && sr.stream
+}
+
+//fromStream finds the element in the stream.  An element without a name is found if it is the only one of its type.
+func (sr *StdinReader) fromStream(element Element) ([]byte, error) {
+	var found []ElementEnvelope
+	var instances []string
+	for _, v := range sr.envelopes {
+		if v.Type == element.Type && (element.Name == "" || v.Name == element.Name) {
+			found = append(found, v)
+			instances = append(instances, v.Instance)
+		}
+	}
+
+	switch {
+	case len(found) == 0:
+		return nil, errors.New("no " + string(element.Type) + " " + element.Name + " found on standard input")
+	case len(found) > 1 && element.Name == "":
+		return nil, errors.New("standard input holds more than one " + string(element.Type) + ", pass --name to pick one")
+	case len(found) > 1:
+		return nil, errors.New(string(element.Type) + " " + element.Name + " is on standard input for more than one instance (" +
+			strings.Join(instances, ", ") + ")")
+	}
+	return found[0].Data, nil
+}
+
+//objects lists the elements in the stream on standard input, so that they can all be restored
+func (sr *StdinReader) objects() ([]backupObject, error) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	err := sr.load()
+	if err != nil {
+		return nil, err
+	}
+	if !sr.stream {
+		return nil, errors.New("standard input does not hold NDJSON written by backup --ndjson")
+	}
+
+	var objects []backupObject
+	for _, v := range sr.envelopes {
+		objects = append(objects, backupObject{
+			location: "-",
+			instance: v.Instance,
+			element:  v.Type,
+			name:     v.Name,
+		})
+	}
+	return objects, nil
+}
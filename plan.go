@@ -0,0 +1,358 @@
+package connect_backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/private/protocol/json/jsonutil"
+	"github.com/aws/aws-sdk-go/service/connect"
+)
+
+//RestorePlan is the set of changes a restore will make to a single element and the Connect API calls needed to make
+//them.  A plan can be saved and applied later, as long as the live element hasn't changed since it was planned.
+type RestorePlan struct {
+	Element    ConnectElement
+	InstanceId string
+	Source     string
+	Name       string
+	//SourceId is the id of the element in the backup, which can differ from the ResourceId restored over
+	SourceId   string `json:",omitempty"`
+	ResourceId string `json:",omitempty"`
+	LiveHash   string `json:",omitempty"`
+	//SourceKeyProvider and SourceKeyId are the key the source was encrypted with, if it was, which the live element is
+	//encrypted with too when it is snapshotted
+	SourceKeyProvider string `json:",omitempty"`
+	SourceKeyId       string `json:",omitempty"`
+	Changes           []FieldChange
+	Calls             []PlannedCall
+	//the live element as it was when planned, kept so it can be snapshotted before it is overwritten
+	live interface{}
+}
+
+//FieldChange is a single difference between the live element and the backup
+type FieldChange struct {
+	Field  string
+	Live   interface{}
+	Backup interface{}
+}
+
+//PlannedCall is a single Connect API call, named by its operation, with the input it will be passed
+type PlannedCall struct {
+	Operation string
+	Input     json.RawMessage
+}
+
+//plannedOperations are the calls a plan for each type of element can make, which are the only ones a saved plan is
+//allowed to run
+var plannedOperations = map[ConnectElement]map[string]bool{
+	Flows: {
+		"CreateContactFlow":        true,
+		"UpdateContactFlowContent": true,
+	},
+	RoutingProfiles: {
+		"CreateRoutingProfile":                     true,
+		"AssociateRoutingProfileQueues":            true,
+		"UpdateRoutingProfileQueues":               true,
+		"DisassociateRoutingProfileQueues":         true,
+		"UpdateRoutingProfileName":                 true,
+		"UpdateRoutingProfileConcurrency":          true,
+		"UpdateRoutingProfileDefaultOutboundQueue": true,
+	},
+	Users: {
+		"CreateUser":                 true,
+		"UpdateUserIdentityInfo":     true,
+		"UpdateUserSecurityProfiles": true,
+		"UpdateUserPhoneConfig":      true,
+		"UpdateUserRoutingProfile":   true,
+		"UpdateUserHierarchy":        true,
+	},
+	HoursOfOperation: {
+		"CreateHoursOfOperation": true,
+		"UpdateHoursOfOperation": true,
+	},
+	Queues: {
+		"CreateQueue":                     true,
+		"UpdateQueueName":                 true,
+		"UpdateQueueHoursOfOperation":     true,
+		"UpdateQueueMaxContacts":          true,
+		"UpdateQueueOutboundCallerConfig": true,
+		"UpdateQueueStatus":               true,
+	},
+}
+
+//addCall adds a call to the plan.  The input isn't built with jsonutil as that leaves out the fields which are sent in
+//the URI, such as the instance id.
+func (p *RestorePlan) addCall(operation string, input interface{}) error {
+	if !plannedOperations[p.Element][operation] {
+		return errors.New(operation + " is not a call a plan for " + string(p.Element) + " can make")
+	}
+	doc, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+
+	var tree interface{}
+	err = json.Unmarshal(doc, &tree)
+	if err != nil {
+		return err
+	}
+
+	doc, err = json.Marshal(dropNulls(tree))
+	if err != nil {
+		return err
+	}
+
+	p.Calls = append(p.Calls, PlannedCall{
+		Operation: operation,
+		Input:     doc,
+	})
+	return nil
+}
+
+func dropNulls(tree interface{}) interface{} {
+	switch tree.(type) {
+	case map[string]interface{}:
+		for k, v := range tree.(map[string]interface{}) {
+			if v == nil {
+				delete(tree.(map[string]interface{}), k)
+			} else {
+				tree.(map[string]interface{})[k] = dropNulls(v)
+			}
+		}
+	case []interface{}:
+		for i, v := range tree.([]interface{}) {
+			tree.([]interface{})[i] = dropNulls(v)
+		}
+	}
+	return tree
+}
+
+//compare records the differences in the named fields between the live and backup versions of an element and reports
+//if there were any
+func (p *RestorePlan) compare(live interface{}, backup interface{}, fields ...string) (bool, error) {
+	liveTree, err := toTree(live)
+	if err != nil {
+		return false, err
+	}
+	backupTree, err := toTree(backup)
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	for _, v := range fields {
+		changes := diffTree(v, field(liveTree, v), field(backupTree, v))
+		if len(changes) > 0 {
+			changed = true
+			p.Changes = append(p.Changes, changes...)
+		}
+	}
+	return changed, nil
+}
+
+//toTree converts a connect element into a generic json tree so it can be compared field by field
+func toTree(element interface{}) (interface{}, error) {
+	doc, err := jsonutil.BuildJSON(element)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree interface{}
+	err = json.Unmarshal(doc, &tree)
+	return tree, err
+}
+
+func field(tree interface{}, name string) interface{} {
+	if m, ok := tree.(map[string]interface{}); ok {
+		return m[name]
+	}
+	return nil
+}
+
+func diffTree(path string, live interface{}, backup interface{}) []FieldChange {
+	var changes []FieldChange
+
+	liveMap, liveIsMap := live.(map[string]interface{})
+	backupMap, backupIsMap := backup.(map[string]interface{})
+	if liveIsMap && backupIsMap {
+		var keys []string
+		for k := range liveMap {
+			keys = append(keys, k)
+		}
+		for k := range backupMap {
+			if _, ok := liveMap[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			changes = append(changes, diffTree(path+"."+k, liveMap[k], backupMap[k])...)
+		}
+		return changes
+	}
+
+	//Json held in a string, such as flow content, can come back from the API laid out differently
+	liveString, liveIsString := live.(string)
+	backupString, backupIsString := backup.(string)
+	if liveIsString && backupIsString && liveString != backupString {
+		var liveDoc, backupDoc map[string]interface{}
+		if json.Unmarshal([]byte(liveString), &liveDoc) == nil && json.Unmarshal([]byte(backupString), &backupDoc) == nil {
+			return diffTree(path, liveDoc, backupDoc)
+		}
+	}
+
+	liveList, liveIsList := live.([]interface{})
+	backupList, backupIsList := backup.([]interface{})
+	if liveIsList && backupIsList && len(liveList) == len(backupList) {
+		for i := range liveList {
+			changes = append(changes, diffTree(path+"["+strconv.Itoa(i)+"]", liveList[i], backupList[i])...)
+		}
+		return changes
+	}
+
+	if !reflect.DeepEqual(live, backup) {
+		changes = append(changes, FieldChange{
+			Field:  path,
+			Live:   live,
+			Backup: backup,
+		})
+	}
+	return changes
+}
+
+//String describes the change, marking fields only in the backup with + and those only in the live element with -
+func (c FieldChange) String() string {
+	live, _ := json.Marshal(c.Live)
+	backup, _ := json.Marshal(c.Backup)
+	switch {
+	case c.Live == nil:
+		return fmt.Sprintf("+ %s: %s", c.Field, backup)
+	case c.Backup == nil:
+		return fmt.Sprintf("- %s: %s", c.Field, live)
+	default:
+		return fmt.Sprintf("~ %s: %s => %s", c.Field, live, backup)
+	}
+}
+
+//hashElement is used to detect if the live element has changed between planning and applying
+func hashElement(element interface{}) (string, error) {
+	doc, err := jsonutil.BuildJSON(element)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(doc)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (p RestorePlan) Print(out io.Writer) {
+	if p.ResourceId == "" {
+		fmt.Fprintf(out, "Plan to create %s %s from %s\n", p.Element, p.Name, p.Source)
+	} else {
+		fmt.Fprintf(out, "Plan to restore %s %s (%s) from %s\n", p.Element, p.Name, p.ResourceId, p.Source)
+	}
+
+	if len(p.Changes) == 0 && len(p.Calls) == 0 {
+		fmt.Fprintln(out, "  No changes, the live element matches the backup")
+		return
+	}
+
+	if len(p.Changes) > 0 {
+		fmt.Fprintln(out, "Changes:")
+		for _, v := range p.Changes {
+			fmt.Fprintln(out, "  "+v.String())
+		}
+	}
+
+	fmt.Fprintln(out, "API calls:")
+	for _, v := range p.Calls {
+		fmt.Fprintf(out, "  %s %s\n", v.Operation, v.Input)
+	}
+}
+
+func (p RestorePlan) Save(fileName string) error {
+	doc, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, doc, 0644)
+}
+
+func LoadPlan(fileName string) (*RestorePlan, error) {
+	fileByte, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var thePlan RestorePlan
+	err = json.Unmarshal(fileByte, &thePlan)
+	if err != nil {
+		return nil, errors.New("could not parse plan " + fileName + ": " + err.Error())
+	}
+	return &thePlan, nil
+}
+
+//execute makes each of the planned calls in order, stopping at the first one to fail.  The operation name is the name
+//of the method on the connect client, which is looked up so plans can be loaded back from a file.  Ids returned by
+//earlier calls fill in those left out of later ones, so a plan can create an element and then add to it.  Each input
+//is passed to prepare before its call is made.
+func (p RestorePlan) execute(connectSvc *connect.Connect, prepare func(*connect.Connect, interface{}) error) error {
+	returned := make(map[string]*string)
+	//a saved plan can have been edited, so only the calls a plan for the element would make are run
+	for _, v := range p.Calls {
+		if !plannedOperations[p.Element][v.Operation] {
+			return errors.New(v.Operation + " is not a call a plan for " + string(p.Element) + " can make, the plan will not be applied")
+		}
+	}
+
+	for _, v := range p.Calls {
+		method := reflect.ValueOf(connectSvc).MethodByName(v.Operation)
+		if !method.IsValid() || method.Type().NumIn() != 1 {
+			return errors.New("unknown operation in plan: " + v.Operation)
+		}
+
+		input := reflect.New(method.Type().In(0).Elem())
+		err := json.Unmarshal(v.Input, input.Interface())
+		if err != nil {
+			return errors.New("could not read input for " + v.Operation + ": " + err.Error())
+		}
+
+		for name, id := range returned {
+			field := input.Elem().FieldByName(name)
+			if field.IsValid() && field.Type() == reflect.TypeOf(id) && field.IsNil() {
+				field.Set(reflect.ValueOf(id))
+			}
+		}
+
+		err = prepare(connectSvc, input.Interface())
+		if err != nil {
+			return err
+		}
+
+		log.Println("Calling " + v.Operation)
+		results := method.Call([]reflect.Value{input})
+		if err, ok := results[1].Interface().(error); ok && err != nil {
+			return errors.New(v.Operation + " failed: " + err.Error())
+		}
+
+		output := results[0].Elem()
+		for i := 0; i < output.NumField(); i++ {
+			field := output.Type().Field(i)
+			if field.PkgPath != "" || !strings.HasSuffix(field.Name, "Id") {
+				continue
+			}
+			if id, ok := output.Field(i).Interface().(*string); ok && id != nil {
+				returned[field.Name] = id
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package connect_backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//Retention is how many daily, weekly and monthly snapshots of each instance a prune keeps.  The newest successful
+//snapshot of each of the most recent days, weeks and months with one is kept, so a snapshot can be kept for more than
+//one reason.  Snapshots of backups which failed or never finished don't count towards any of them.
+type Retention struct {
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+//PruneResult is what a prune did, or would do, with a single snapshot
+type PruneResult struct {
+	Snapshot BackupSnapshot
+	Keep     bool
+	Reasons  []string
+}
+
+//The most objects S3 will delete in a single call
+const s3DeleteBatch = 1000
+
+//retain works out which of the snapshots of a single instance, oldest first, to keep.  succeeded says which of them
+//are of backups which finished without failures.  The snapshot marked as the latest is always kept, as are any newer
+//than it as they may still be being written.  Where no snapshot is marked the newest is kept instead.
+func (r Retention) retain(snapshots []BackupSnapshot, succeeded []bool) []PruneResult {
+
+	results := make([]PruneResult, len(snapshots))
+	for i, v := range snapshots {
+		results[i].Snapshot = v
+	}
+
+	latest := len(snapshots) - 1
+	for i, v := range snapshots {
+		if v.Latest {
+			latest = i
+		}
+	}
+	for i := len(snapshots) - 1; i >= latest && i >= 0; i-- {
+		results[i].Keep = true
+		if i == latest {
+			results[i].Reasons = append(results[i].Reasons, latestMarker)
+		} else {
+			results[i].Reasons = append(results[i].Reasons, "newer than "+latestMarker)
+		}
+	}
+
+	periods := []struct {
+		reason string
+		keep   int
+		period func(BackupSnapshot) string
+	}{
+		{"daily", r.Daily, func(s BackupSnapshot) string {
+			return s.Timestamp.UTC().Format("2006-01-02")
+		}},
+		{"weekly", r.Weekly, func(s BackupSnapshot) string {
+			year, week := s.Timestamp.UTC().ISOWeek()
+			return strconv.Itoa(year) + "-" + strconv.Itoa(week)
+		}},
+		{"monthly", r.Monthly, func(s BackupSnapshot) string {
+			return s.Timestamp.UTC().Format("2006-01")
+		}},
+	}
+
+	for _, p := range periods {
+		seen := make(map[string]bool)
+		for i := len(snapshots) - 1; i >= 0 && len(seen) < p.keep; i-- {
+			if !succeeded[i] {
+				continue
+			}
+			period := p.period(snapshots[i])
+			if seen[period] {
+				continue
+			}
+			seen[period] = true
+			results[i].Keep = true
+			results[i].Reasons = append(results[i].Reasons, p.reason)
+		}
+	}
+
+	for i := range results {
+		if !results[i].Keep && !succeeded[i] {
+			results[i].Reasons = append(results[i].Reasons, "failed or unfinished")
+		}
+	}
+	return results
+}
+
+//snapshotSucceeded reads the manifest of a snapshot to tell if its backup finished without failures.  A snapshot with
+//no manifest, written before they were, is taken to have succeeded as there is nothing to say it didn't.
+func snapshotSucceeded(sess *session.Session, keys KeyWrapper, location string) (bool, error) {
+
+	var reader Reader = FileReader{BasePath: location}
+	if snapshotLocation, err := url.Parse(location); err == nil && snapshotLocation.Scheme == "s3" {
+		reader = S3Reader{Bucket: snapshotLocation.Host, Prefix: snapshotLocation.Path, Sess: sess}
+	}
+	reader = &DecryptingReader{Reader: reader, Sess: sess, Keys: keys}
+
+	document, err := reader.Read(Element{Type: Manifest})
+	if failure, ok := err.(awserr.RequestFailure); (ok && failure.StatusCode() == http.StatusNotFound) || os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.New("could not read the manifest of " + location + ": " + err.Error())
+	}
+
+	var manifest BackupManifest
+	err = json.Unmarshal(document, &manifest)
+	if err != nil {
+		return false, errors.New("could not parse the manifest of " + location + ": " + err.Error())
+	}
+	return manifest.Finished != nil && len(manifest.Failed) == 0, nil
+}
+
+//Prune deletes the snapshots under a local directory or S3 prefix which the retention doesn't keep, listing what is
+//kept and deleted to out.  With dryRun nothing is deleted.  The options are those the backup was written with, and the
+//keys unwrap the manifests of a backup encrypted with a local key to tell which snapshots succeeded.
+//Deleting from a versioned bucket leaves the earlier versions behind, which need a lifecycle rule to clear them up, and
+//Object Lock keeps them until their retention ends.
+func Prune(sess *session.Session, root string, options S3Options, keys KeyWrapper, retention Retention, dryRun bool, out io.Writer) ([]PruneResult, error) {
+
+	if isArchive(root) {
+		return nil, errors.New("snapshots can't be pruned from an archive")
+	}
+
+	snapshots, err := Snapshots(sess, root)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		fmt.Fprintln(out, "No snapshots found under "+root)
+		return nil, nil
+	}
+
+	var results []PruneResult
+	for start := 0; start < len(snapshots); {
+		end := start
+		for end < len(snapshots) && snapshots[end].Instance == snapshots[start].Instance {
+			end++
+		}
+		succeeded := make([]bool, end-start)
+		for i, v := range snapshots[start:end] {
+			succeeded[i], err = snapshotSucceeded(sess, keys, v.Location)
+			if err != nil {
+				return nil, err
+			}
+		}
+		results = append(results, retention.retain(snapshots[start:end], succeeded)...)
+		start = end
+	}
+
+	deleted := "delete"
+	if dryRun {
+		deleted = "would delete"
+	}
+
+	var failures []string
+	removed := 0
+	instance := ""
+	for _, v := range results {
+		if v.Snapshot.Instance != instance {
+			instance = v.Snapshot.Instance
+			fmt.Fprintln(out, instance+":")
+		}
+		if v.Keep {
+			fmt.Fprintf(out, "  %-12s  %s  (%s)\n", "keep", v.Snapshot.Timestamp.Format(time.RFC3339), strings.Join(v.Reasons, ", "))
+			continue
+		}
+
+		if len(v.Reasons) > 0 {
+			fmt.Fprintf(out, "  %-12s  %s  (%s)\n", deleted, v.Snapshot.Timestamp.Format(time.RFC3339), strings.Join(v.Reasons, ", "))
+		} else {
+			fmt.Fprintf(out, "  %-12s  %s\n", deleted, v.Snapshot.Timestamp.Format(time.RFC3339))
+		}
+		if dryRun {
+			continue
+		}
+		err = deleteSnapshot(sess, options, v.Snapshot.Location)
+		if err != nil {
+			log.Println("Could not delete " + v.Snapshot.Location + ": " + err.Error())
+			failures = append(failures, v.Snapshot.Location)
+			continue
+		}
+		removed++
+	}
+
+	if !dryRun {
+		log.Println("Deleted " + strconv.Itoa(removed) + " snapshots from " + root)
+		if removed > 0 && options.locking() {
+			log.Println("Object Lock keeps the earlier versions of the deleted snapshots until their retention ends")
+		}
+	}
+
+	if len(failures) > 0 {
+		return results, errors.New("could not delete " + strconv.Itoa(len(failures)) + " snapshots: " + strings.Join(failures, ", "))
+	}
+	return results, nil
+}
+
+//deleteSnapshot removes the directory, or every object under the S3 prefix, of a snapshot.  A snapshot with no objects
+//under its prefix is an error, as the listing it was found in said otherwise.
+func deleteSnapshot(sess *session.Session, options S3Options, location string) error {
+
+	snapshotLocation, err := url.Parse(location)
+	if err != nil || snapshotLocation.Scheme != "s3" {
+		return os.RemoveAll(location)
+	}
+
+	s3Svc := s3.New(sess)
+	var keys []*s3.ObjectIdentifier
+	err = s3Svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:              aws.String(snapshotLocation.Host),
+		Prefix:              aws.String(s3Prefix(snapshotLocation.Path + "/")),
+		ExpectedBucketOwner: optional(options.ExpectedBucketOwner),
+	}, func(output *s3.ListObjectsV2Output, b bool) bool {
+		for _, v := range output.Contents {
+			keys = append(keys, &s3.ObjectIdentifier{Key: v.Key})
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("no objects found under " + location)
+	}
+
+	for start := 0; start < len(keys); start += s3DeleteBatch {
+		end := start + s3DeleteBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		result, err := s3Svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(snapshotLocation.Host),
+			Delete: &s3.Delete{
+				Objects: keys[start:end],
+				Quiet:   aws.Bool(true),
+			},
+			ExpectedBucketOwner: optional(options.ExpectedBucketOwner),
+		})
+		if err != nil {
+			return err
+		}
+		if len(result.Errors) > 0 {
+			return errors.New(aws.StringValue(result.Errors[0].Key) + ": " + aws.StringValue(result.Errors[0].Message))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package connect_backup
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetainSkipsFailedSnapshots(t *testing.T) {
+	snapshot := func(timestamp string, latest bool) BackupSnapshot {
+		parsed, err := time.Parse(time.RFC3339, timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return BackupSnapshot{Instance: "inst", Timestamp: parsed, Latest: latest}
+	}
+	snapshots := []BackupSnapshot{
+		snapshot("2026-10-01T01:00:00Z", false),
+		snapshot("2026-10-01T05:00:00Z", false),
+		snapshot("2026-10-02T01:00:00Z", false),
+		snapshot("2026-10-02T05:00:00Z", false),
+		snapshot("2026-10-03T01:00:00Z", true),
+		snapshot("2026-10-03T05:00:00Z", false),
+	}
+	succeeded := []bool{true, false, true, false, true, false}
+
+	results := Retention{Daily: 3}.retain(snapshots, succeeded)
+
+	want := []string{"daily", "failed or unfinished", "daily", "failed or unfinished", "latest, daily", "newer than latest"}
+	for i, v := range results {
+		if got := strings.Join(v.Reasons, ", "); got != want[i] {
+			t.Errorf("%s: reasons %q, want %q", v.Snapshot.Timestamp.Format(time.RFC3339), got, want[i])
+		}
+		if keep := want[i] != "failed or unfinished"; v.Keep != keep {
+			t.Errorf("%s: keep %t, want %t", v.Snapshot.Timestamp.Format(time.RFC3339), v.Keep, keep)
+		}
+	}
+}
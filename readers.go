@@ -0,0 +1,336 @@
+package connect_backup
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//Reader is a backup that a restore reads elements from.  Elements are found by their type and name, laid out the same
+//way the writers lay them out.
+type Reader interface {
+	//Read returns the document written for the element
+	Read(element Element) ([]byte, error)
+}
+
+//FileReader reads the backup of an instance from the directory it was written to
+type FileReader struct {
+	BasePath string
+}
+
+//S3Reader reads the backup of an instance from the S3 prefix it was written to.  In a versioned bucket either a
+//particular version of the element, or the version current at a point in time, can be read.
+type S3Reader struct {
+	Bucket    string
+	Prefix    string
+	Sess      *session.Session
+	VersionId string
+	AsOf      time.Time
+}
+
+//StdinReader reads a single element from standard input, or any of the elements in the NDJSON written by a StdoutWriter
+type StdinReader struct {
+	In io.Reader
+
+	lock      sync.Mutex
+	read      bool
+	err       error
+	element   Element
+	document  []byte
+	stream    bool
+	envelopes []ElementEnvelope
+}
+
+//ArchiveReader reads the backup of an instance from a .tar.gz, .tgz or .zip archive, which can be a local file or an
+//S3 URL.  Prefix is the path within the archive of the instance, if the archive holds more than one.
+type ArchiveReader struct {
+	File   string
+	Prefix string
+	Sess   *session.Session
+
+	lock    sync.Mutex
+	entries map[string][]byte
+}
+
+//archiveSeparator splits the archive from the path of an element within it, e.g. backup.tar.gz#instance/flows/Main.json
+const archiveSeparator = "#"
+
+func (fr FileReader) Read(element Element) ([]byte, error) {
+	return readAny(element, func(element Element) ([]byte, error) {
+		return ioutil.ReadFile(fr.BasePath + string(os.PathSeparator) + element.Path(string(os.PathSeparator)))
+	})
+}
+
+//key is the S3 key of the element, in the cleaned form S3 stores it in, the same as the key S3Writer writes it to
+func (sr S3Reader) key(element Element) string {
+	return s3Key(sr.Prefix + "/" + element.Path("/"))
+}
+
+func (sr S3Reader) Read(element Element) ([]byte, error) {
+	return readAny(element, sr.read)
+}
+
+func (sr S3Reader) read(element Element) ([]byte, error) {
+	s3Svc := s3.New(sr.Sess)
+	key := sr.key(element)
+
+	var versionId *string
+	if sr.VersionId != "" {
+		versionId = aws.String(sr.VersionId)
+	} else if !sr.AsOf.IsZero() {
+		found, err := versionAsOf(s3Svc, sr.Bucket, key, sr.AsOf)
+		if err != nil {
+			return nil, errors.New("could not find the version of s3://" + sr.Bucket + "/" + key + " to read: " + err.Error())
+		}
+		versionId = aws.String(found)
+	}
+
+	result, err := s3Svc.GetObject(&s3.GetObjectInput{
+		Bucket:    aws.String(sr.Bucket),
+		Key:       aws.String(key),
+		VersionId: versionId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer result.Body.Close()
+	return ioutil.ReadAll(result.Body)
+}
+
+//alongsideReader is implemented by readers which can read a particular version of an element, and so need to find
+//the other elements written along with that version
+type alongsideReader interface {
+	alongside(element Element) (Reader, error)
+}
+
+//alongside returns a reader for the other elements written by the same backup as the version of the element being read
+func (sr S3Reader) alongside(element Element) (Reader, error) {
+	if sr.VersionId == "" {
+		return &sr, nil
+	}
+
+	written, err := versionTime(s3.New(sr.Sess), sr.Bucket, sr.key(element), sr.VersionId)
+	if err != nil {
+		return nil, err
+	}
+	sr.VersionId = ""
+	sr.AsOf = written.Add(queueVersionWindow)
+	return &sr, nil
+}
+
+//Read returns whatever is on standard input for the first element read.  Standard input can only be read once, so
+//reading it again for the same element returns the same document and reading any other element fails.  If standard
+//input holds NDJSON written by a StdoutWriter, any of the elements in it can be read.
+func (sr *StdinReader) Read(element Element) ([]byte, error) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	err := sr.load()
+	if err != nil {
+		return nil, err
+	}
+	if sr.stream {
+		return sr.fromStream(element)
+	}
+	if sr.element.Type == "" {
+		sr.element = element
+	}
+
+	if element.Type != sr.element.Type || element.Name != sr.element.Name {
+		return nil, errors.New("only a single element can be read from standard input, " + string(element.Type) + " " + element.Name + " can't be read")
+	}
+	return sr.document, nil
+}
+
+func (ar *ArchiveReader) Read(element Element) ([]byte, error) {
+	entries, err := ar.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return readAny(element, func(element Element) ([]byte, error) {
+		name := ar.Prefix + element.Path("/")
+		document, found := entries[name]
+		if !found {
+			return nil, errors.New(name + " not found in " + ar.File)
+		}
+		return document, nil
+	})
+}
+
+//load reads every file in the archive, which is only done once
+func (ar *ArchiveReader) load() (map[string][]byte, error) {
+	ar.lock.Lock()
+	defer ar.lock.Unlock()
+
+	if ar.entries != nil {
+		return ar.entries, nil
+	}
+
+	entries, err := readArchive(ar.File, ar.Sess)
+	if err != nil {
+		return nil, errors.New("could not read archive " + ar.File + ": " + err.Error())
+	}
+	ar.entries = entries
+	return entries, nil
+}
+
+func isArchive(fileName string) bool {
+	return strings.HasSuffix(fileName, ".tar.gz") || strings.HasSuffix(fileName, ".tgz") || strings.HasSuffix(fileName, ".zip")
+}
+
+//readArchive returns the contents of every file in a .tar.gz, .tgz or .zip archive by its path within the archive.  The
+//archive can be a local file or an S3 URL.
+func readArchive(fileName string, sess *session.Session) (map[string][]byte, error) {
+
+	var data []byte
+	archiveLocation, err := url.Parse(fileName)
+	if err == nil && archiveLocation.Scheme == "s3" {
+		result, err := s3.New(sess).GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(archiveLocation.Host),
+			Key:    aws.String(archiveLocation.Path),
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer result.Body.Close()
+		data, err = ioutil.ReadAll(result.Body)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		data, err = ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	entries := make(map[string][]byte)
+
+	if strings.HasSuffix(fileName, ".zip") {
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range archive.File {
+			if v.FileInfo().IsDir() {
+				continue
+			}
+			entry, err := v.Open()
+			if err != nil {
+				return nil, err
+			}
+			entries[path.Clean(v.Name)], err = ioutil.ReadAll(entry)
+			entry.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return entries, nil
+	}
+
+	compressed, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	archive := tar.NewReader(compressed)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		entries[path.Clean(header.Name)], err = ioutil.ReadAll(archive)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+//elementAt works out which element of a backup is at the end of a path, and the path of the instance it belongs to
+func elementAt(location string, separator string) (string, Element) {
+
+	elementDir := location[:strings.LastIndex(location, separator)+1]
+	name, format, _ := splitFormat(location[len(elementDir):])
+	elementDir = strings.TrimSuffix(elementDir, separator)
+	base := elementDir[:strings.LastIndex(elementDir, separator)+1]
+
+	element := Element{
+		Type:   ConnectElement(elementDir[len(base):]),
+		Name:   name,
+		Format: format,
+	}
+	if element.Type == common {
+		element.Type = ConnectElement(name)
+	}
+	return base, element
+}
+
+//openSource works out how to read the source, which can be the location of a single element in a local or S3 backup,
+//a path within an archive, or - for standard input
+func openSource(source string, sess *session.Session, versionId string, asOf time.Time) (Reader, Element, error) {
+
+	if (versionId != "" || !asOf.IsZero()) && !strings.HasPrefix(source, "s3://") {
+		return nil, Element{}, errors.New("versions can only be restored from S3 sources")
+	}
+
+	switch {
+	case source == "-":
+		return &StdinReader{}, Element{}, nil
+
+	case strings.Contains(source, archiveSeparator) && isArchive(source[:strings.Index(source, archiveSeparator)]):
+		i := strings.Index(source, archiveSeparator)
+		base, element := elementAt(path.Clean(source[i+1:]), "/")
+		return &ArchiveReader{
+			File:   source[:i],
+			Prefix: base,
+			Sess:   sess,
+		}, element, nil
+
+	case strings.HasPrefix(source, "s3://"):
+		bucket := strings.TrimPrefix(source, "s3://")
+		key := ""
+		if i := strings.Index(bucket, "/"); i >= 0 {
+			bucket, key = bucket[:i], bucket[i:]
+		}
+		base, element := elementAt(key, "/")
+		return &S3Reader{
+			Bucket:    bucket,
+			Prefix:    strings.TrimSuffix(base, "/"),
+			Sess:      sess,
+			VersionId: versionId,
+			AsOf:      asOf,
+		}, element, nil
+
+	}
+
+	fileName, err := filepath.Abs(source)
+	if err != nil {
+		return nil, Element{}, err
+	}
+	base, element := elementAt(fileName, string(os.PathSeparator))
+	return FileReader{
+		BasePath: strings.TrimSuffix(base, string(os.PathSeparator)),
+	}, element, nil
+}
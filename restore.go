@@ -1,14 +1,14 @@
 package connect_backup
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
-	"io"
-	"io/ioutil"
 	"log"
-	"net/url"
-	"os"
-	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws/arn"
 
@@ -20,292 +20,908 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 
 	"github.com/sethvargo/go-password/password"
 )
 
-type sourceType int
-
-const (
-	fileSource sourceType = iota
-	s3Source              = iota
-)
-
 type ConnectRestore struct {
 	ConnectInstanceId *string
 	Session           session.Session
 	Source            string
-	location          sourceType
-	url               url.URL
 	Element           ConnectElement
 	NewName           string
+	Mapping           *Mapping
+	//Snapshot, if set, is where the live element is saved before it is overwritten.  Without it nothing is saved.
+	Snapshot Writer
+	//RollbackOnFailure restores the snapshot if the restore fails part way through.  It needs a Snapshot, without one
+	//a failed restore is left as it is.
+	RollbackOnFailure bool
+	//For S3 sources in a versioned bucket, restore a particular version or the version current at a point in time
+	VersionId string
+	AsOf      time.Time
+	//Instead of a Source, the element with this Name can be found under a local or S3 BackupRoot
+	BackupRoot string
+	Name       string
+	//When the Source is a directory or S3 prefix, the glob patterns of the names to restore and how many to restore
+	//at once
+	Include     []string
+	Exclude     []string
+	Parallelism int
+	//When creating a user whose username already exists, update them in place rather than failing
+	UpdateExisting bool
+	//Where the initial password of a created user is delivered.  Without one it is discarded.
+	Credentials CredentialStore
+	//Verify describes the element again once it has been restored and fails if it doesn't match the backup
+	Verify bool
+	//Reader, if set, is read from instead of working out how to read the Source
+	Reader Reader
+	//Keys unwraps the data keys of backups encrypted with a local key.  Backups encrypted with KMS are decrypted using
+	//the Session.
+	Keys KeyWrapper
+	//targetId is the live element to restore over when it differs from the id in the backup
+	targetId string
 	//destinationArn    arn.ARN
 	sourceArn arn.ARN
+	//sourceKey records the key the source was encrypted with while it is planned
+	sourceKey *sourceKey
 }
 
+//Restore restores the source over the top of the live element, or creates a new one, making only the API calls needed
+//to bring it in line with the backup
 func (cr ConnectRestore) Restore() error {
 
+	thePlan, err := cr.Plan()
+	if err != nil {
+		return err
+	}
+
+	if len(thePlan.Calls) == 0 {
+		log.Println("The live " + string(thePlan.Element) + " " + thePlan.Name + " already matches the backup")
+		return nil
+	}
+
+	connectSvc := connect.New(&cr.Session)
+	err = cr.run(connectSvc, *thePlan)
+	if err != nil || !cr.Verify {
+		return err
+	}
+	return cr.verify(connectSvc, *thePlan)
+}
+
+//VerifyError is returned when a restored element still differs from the backup
+type VerifyError struct {
+	Element ConnectElement
+	Name    string
+	Changes []FieldChange
+}
+
+func (e VerifyError) Error() string {
+	message := "the restored " + string(e.Element) + " " + e.Name + " does not match the backup:"
+	for _, v := range e.Changes {
+		message += "\n  " + v.String()
+	}
+	return message
+}
+
+//verify plans the restore again against the element that was restored.  Planning compares the fields a restore sets,
+//leaving out ARNs, ids and timestamps, so any change left in the new plan didn't stick.
+func (cr ConnectRestore) verify(connectSvc *connect.Connect, thePlan RestorePlan) error {
+
+	recheck := cr
+	recheck.Source = thePlan.Source
+	recheck.BackupRoot = ""
+	recheck.NewName = ""
+	recheck.targetId = thePlan.ResourceId
+
+	//a created element is found by its name
+	if recheck.targetId == "" {
+		live, err := cr.liveNames(connectSvc, thePlan.Element)
+		if err != nil {
+			return errors.New("could not verify " + string(thePlan.Element) + " " + thePlan.Name + ": " + err.Error())
+		}
+		id, found := live[thePlan.Name]
+		if !found {
+			return errors.New("could not verify " + string(thePlan.Element) + " " + thePlan.Name + ", it was not found after restoring")
+		}
+		recheck.targetId = id
+	}
+
+	newPlan, err := recheck.Plan()
+	if err != nil {
+		return errors.New("could not verify " + string(thePlan.Element) + " " + thePlan.Name + ": " + err.Error())
+	}
+
+	var changes []FieldChange
+	for _, v := range newPlan.Changes {
+		//an element created under a new name isn't expected to have the name in the backup
+		if cr.NewName != "" && v.Field == "Name" {
+			continue
+		}
+		changes = append(changes, v)
+	}
+
+	if len(changes) > 0 {
+		return VerifyError{
+			Element: thePlan.Element,
+			Name:    thePlan.Name,
+			Changes: changes,
+		}
+	}
+	log.Println("Verified the live " + string(thePlan.Element) + " " + thePlan.Name + " matches the backup")
+	return nil
+}
+
+const snapshotPrefix = "pre-restore"
+
+var snapshotLock sync.Mutex
+
+//run snapshots the live element, if there is one, and then makes the planned calls.  If any of the calls fail the
+//snapshot can be restored, putting back anything which was changed before the failure.
+func (cr ConnectRestore) run(connectSvc *connect.Connect, thePlan RestorePlan) error {
+
+	if thePlan.live != nil && cr.Snapshot == nil && cr.RollbackOnFailure {
+		log.Println("There is nowhere to save the live " + string(thePlan.Element) + " " + thePlan.Name + " to, it can't be rolled back if the restore fails")
+	}
+
+	var snapshotLocation string
+	if thePlan.live != nil && cr.Snapshot != nil {
+		var err error
+		cr.Snapshot, err = cr.snapshotWriter(thePlan)
+		if err != nil {
+			return errors.New("could not snapshot the live " + string(thePlan.Element) + " " + thePlan.Name + " before restoring: " + err.Error())
+		}
+		snapshotLocation, err = cr.snapshot(thePlan)
+		if err != nil {
+			return errors.New("could not snapshot the live " + string(thePlan.Element) + " " + thePlan.Name + " before restoring: " + err.Error())
+		}
+		log.Println("Saved the live " + string(thePlan.Element) + " " + thePlan.Name + " to " + snapshotLocation)
+		undo := "connect-backup --instance " + thePlan.InstanceId + " restore --type " + string(thePlan.Element) + " \"" + snapshotLocation + "\""
+		if thePlan.SourceKeyProvider == (LocalKeys{}).Provider() {
+			undo += " --key-file <the key file>"
+		}
+		log.Println("To undo this restore run: " + undo)
+	}
+
+	for _, v := range thePlan.Changes {
+		log.Println(string(thePlan.Element) + " " + thePlan.Name + ": " + v.String())
+	}
+
+	err := thePlan.execute(connectSvc, cr.prepareInput)
+
+	if err != nil && cr.RollbackOnFailure && snapshotLocation != "" {
+		log.Println("Restore failed, rolling back to " + snapshotLocation)
+		//the rollback is restored with the same settings, reading the snapshot rather than wherever the source was read
+		//from over the element the plan changed, and isn't rolled back itself
+		rollback := cr
+		rollback.Source = snapshotLocation
+		rollback.Element = thePlan.Element
+		rollback.NewName = ""
+		rollback.targetId = thePlan.ResourceId
+		rollback.Reader = nil
+		rollback.BackupRoot = ""
+		rollback.VersionId = ""
+		rollback.AsOf = time.Time{}
+		rollback.RollbackOnFailure = false
+		rollbackErr := rollback.Restore()
+		if rollbackErr != nil {
+			return errors.New(err.Error() + ". The rollback also failed: " + rollbackErr.Error())
+		}
+		return errors.New(err.Error() + ". The live " + string(thePlan.Element) + " " + thePlan.Name + " was rolled back")
+	}
+
+	return err
+}
+
+//snapshotWriter returns the writer to snapshot the live element to, which encrypts it with the key the source was
+//encrypted with so a restore from an encrypted backup doesn't leave the live element lying around unencrypted
+func (cr ConnectRestore) snapshotWriter(thePlan RestorePlan) (Writer, error) {
+	switch {
+	case thePlan.SourceKeyProvider == "":
+		return cr.Snapshot, nil
+	case thePlan.SourceKeyProvider == KMSKeys{}.Provider():
+		return &EncryptingWriter{Writer: cr.Snapshot, Keys: KMSKeys{KeyId: thePlan.SourceKeyId, Sess: &cr.Session}}, nil
+	case cr.Keys != nil && cr.Keys.Provider() == thePlan.SourceKeyProvider:
+		return &EncryptingWriter{Writer: cr.Snapshot, Keys: cr.Keys}, nil
+	}
+	return nil, errors.New("the source was encrypted with a " + thePlan.SourceKeyProvider + " key, which must be given to encrypt the snapshot with")
+}
+
+//snapshot writes the live element into a timestamped pre-restore location using the same layout as a backup, so it
+//can be restored from directly
+func (cr ConnectRestore) snapshot(thePlan RestorePlan) (string, error) {
+
+	//the writer may be shared by restores running in parallel
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+
+	err := cr.Snapshot.Init(snapshotPrefix + "/" + time.Now().UTC().Format("20060102T150405Z") + "/" + thePlan.InstanceId)
+	if err != nil {
+		return "", err
+	}
+
+	live := thePlan.live
+	if profile, ok := live.(liveRoutingProfile); ok {
+		err = writeElementList(cr.Snapshot, thePlan.InstanceId, *profile.RoutingProfile.RoutingProfileId, profile.Queues)
+		if err != nil {
+			return "", err
+		}
+		live = profile.RoutingProfile
+	}
+
+	err = writeElement(cr.Snapshot, thePlan.InstanceId, live)
+	if err != nil {
+		return "", err
+	}
+
+	element, err := describeElement(thePlan.InstanceId, live)
+	if err != nil {
+		return "", err
+	}
+	return cr.Snapshot.Location(element)
+}
+
+//Plan works out the changes restoring the source would make and the API calls needed to make them, without making any
+//changes
+func (cr ConnectRestore) Plan() (*RestorePlan, error) {
+
+	connectSvc := connect.New(&cr.Session)
+
+	if cr.BackupRoot != "" && cr.Name != "" {
+		var err error
+		cr.Source, err = cr.findSource()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cr.sourceKey = &sourceKey{}
+	thePlan, err := cr.planElement(connectSvc)
+	if thePlan != nil {
+		thePlan.SourceKeyProvider, thePlan.SourceKeyId = cr.sourceKey.provider, cr.sourceKey.keyId
+	}
+	return thePlan, err
+}
+
+//planElement plans the restore of the type of element being restored
+func (cr ConnectRestore) planElement(connectSvc *connect.Connect) (*RestorePlan, error) {
+
 	switch cr.Element {
 	case Flows:
-		return cr.restoreFlow()
+		return cr.planFlow(connectSvc)
 	case RoutingProfiles:
-		return cr.restoreRoutingProfile()
+		return cr.planRoutingProfile(connectSvc)
 	case Users:
-		return cr.restoreUser()
+		return cr.planUser(connectSvc)
+	case HoursOfOperation:
+		return cr.planHoursOfOperation(connectSvc)
+	case Queues:
+		return cr.planQueue(connectSvc)
 
 	default:
-		return errors.New("only restoration of contact flows is supported for now")
+		return nil, errors.New("only restoration of contact flows, routing profiles, users, hours of operation and queues is supported for now")
 	}
 }
 
-func (cr ConnectRestore) restoreUser() error {
-	var theUser connect.User
-
-	cr.readSource(&theUser)
+//Apply makes the calls in a previously saved plan.  The plan is rejected if the live element has changed since it was
+//planned, or for a plan which creates the element, if one with the same name has been created since.
+func (cr ConnectRestore) Apply(thePlan RestorePlan) error {
 
 	connectSvc := connect.New(&cr.Session)
+	cr.ConnectInstanceId = aws.String(thePlan.InstanceId)
 
-	var err error
-
-	//if we have a new user name then we are creating a new flow with the backup, rather than restoring over the top of
-	//the old flow.
-	if cr.NewName != "" {
-		var newProfile connect.CreateUserInput
-		awsutil.Copy(&newProfile, &theUser)
-		newProfile.Username = aws.String(cr.NewName)
-		newProfile.InstanceId = cr.ConnectInstanceId
-		newProfile.DirectoryUserId = nil
+	//a plan to create an element has neither, so one with a live hash but nothing to describe has been edited
+	if thePlan.ResourceId == "" && thePlan.LiveHash != "" {
+		return errors.New("the plan for " + string(thePlan.Element) + " " + thePlan.Name + " has a live hash but no resource id, plan the restore again")
+	}
 
-		res, err := password.Generate(64, 10, 10, false, false)
+	if thePlan.ResourceId == "" {
+		names, err := cr.liveNames(connectSvc, thePlan.Element)
 		if err != nil {
-			log.Fatal("Could not generate new temporary password: " + err.Error())
+			return errors.New("could not list the live " + string(thePlan.Element) + ": " + err.Error())
+		}
+		if _, ok := names[thePlan.Name]; ok {
+			return errors.New("a " + string(thePlan.Element) + " named " + thePlan.Name + " has been created since the plan was made, plan the restore again")
+		}
+	} else {
+		live, err := cr.describeLive(connectSvc, thePlan.Element, thePlan.ResourceId)
+		if err != nil {
+			return errors.New("could not describe the live " + string(thePlan.Element) + " " + thePlan.Name + ": " + err.Error())
 		}
-		newProfile.Password = aws.String(res)
-		newProfile.Tags = nil
-
-		_, err = connectSvc.CreateUser(&newProfile)
 
+		liveHash, err := hashElement(live)
 		if err != nil {
-			log.Fatal("Could not Create User: " + err.Error())
+			return err
+		}
 
+		if liveHash != thePlan.LiveHash {
+			return errors.New("the live " + string(thePlan.Element) + " " + thePlan.Name + " has changed since the plan was made, plan the restore again")
 		}
+		thePlan.live = live
+	}
 
-	} else {
-		//Update the existing flow in place, this requires several operations.
+	return cr.run(connectSvc, thePlan)
+}
+
+func (cr ConnectRestore) newPlan(name string) RestorePlan {
+	return RestorePlan{
+		Element:    cr.Element,
+		InstanceId: *cr.ConnectInstanceId,
+		Source:     cr.Source,
+		Name:       name,
+	}
+}
+
+//liveRoutingProfile is a routing profile along with its queues, which have to be fetched separately
+type liveRoutingProfile struct {
+	RoutingProfile connect.RoutingProfile
+	Queues         []*connect.RoutingProfileQueueConfigSummary
+}
+
+//describeLive fetches the current version of an element from the instance
+func (cr ConnectRestore) describeLive(connectSvc *connect.Connect, element ConnectElement, id string) (interface{}, error) {
+
+	switch element {
+	case Flows:
+		result, err := connectSvc.DescribeContactFlow(&connect.DescribeContactFlowInput{
+			InstanceId:    cr.ConnectInstanceId,
+			ContactFlowId: aws.String(id),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return *result.ContactFlow, nil
 
-		//First update the profile name and description
-		_, err = connectSvc.UpdateUserIdentityInfo(&connect.UpdateUserIdentityInfoInput{
-			InstanceId:   cr.ConnectInstanceId,
-			UserId:       theUser.Id,
-			IdentityInfo: theUser.IdentityInfo,
+	case Users:
+		result, err := connectSvc.DescribeUser(&connect.DescribeUserInput{
+			InstanceId: cr.ConnectInstanceId,
+			UserId:     aws.String(id),
 		})
+		if err != nil {
+			return nil, err
+		}
+		return *result.User, nil
 
+	case RoutingProfiles:
+		result, err := connectSvc.DescribeRoutingProfile(&connect.DescribeRoutingProfileInput{
+			InstanceId:       cr.ConnectInstanceId,
+			RoutingProfileId: aws.String(id),
+		})
 		if err != nil {
-			log.Fatal("Could not Update User Identity Info: " + err.Error())
+			return nil, err
+		}
 
+		live := liveRoutingProfile{
+			RoutingProfile: *result.RoutingProfile,
 		}
+		err = connectSvc.ListRoutingProfileQueuesPages(&connect.ListRoutingProfileQueuesInput{
+			InstanceId:       cr.ConnectInstanceId,
+			RoutingProfileId: aws.String(id),
+		}, func(output *connect.ListRoutingProfileQueuesOutput, b bool) bool {
+			live.Queues = append(live.Queues, output.RoutingProfileQueueConfigSummaryList...)
+			return true
+		})
+		return live, err
 
-		_, err = connectSvc.UpdateUserSecurityProfiles(&connect.UpdateUserSecurityProfilesInput{
+	case HoursOfOperation:
+		result, err := connectSvc.DescribeHoursOfOperation(&connect.DescribeHoursOfOperationInput{
 			InstanceId:         cr.ConnectInstanceId,
-			UserId:             theUser.Id,
-			SecurityProfileIds: theUser.SecurityProfileIds,
+			HoursOfOperationId: aws.String(id),
 		})
-
 		if err != nil {
-			log.Fatal("Could not Update User Security Profile: " + err.Error())
+			return nil, err
 		}
+		return *result.HoursOfOperation, nil
 
-		_, err = connectSvc.UpdateUserPhoneConfig(&connect.UpdateUserPhoneConfigInput{
-			InstanceId:  cr.ConnectInstanceId,
-			UserId:      theUser.Id,
-			PhoneConfig: theUser.PhoneConfig,
+	case Queues:
+		result, err := connectSvc.DescribeQueue(&connect.DescribeQueueInput{
+			InstanceId: cr.ConnectInstanceId,
+			QueueId:    aws.String(id),
 		})
-
 		if err != nil {
-			log.Fatal("Could not Update User Phone config: " + err.Error())
+			return nil, err
 		}
+		return *result.Queue, nil
 
-		_, err = connectSvc.UpdateUserRoutingProfile(&connect.UpdateUserRoutingProfileInput{
-			InstanceId:       cr.ConnectInstanceId,
-			UserId:           theUser.Id,
-			RoutingProfileId: theUser.RoutingProfileId,
+	default:
+		return nil, errors.New("unexpected element type " + string(element))
+	}
+}
+
+//describeForPlan fetches the live element being restored over and records its state against the plan
+func (cr ConnectRestore) describeForPlan(connectSvc *connect.Connect, thePlan *RestorePlan, id string) (interface{}, error) {
+
+	live, err := cr.describeLive(connectSvc, thePlan.Element, id)
+	if err != nil {
+		return nil, errors.New("could not describe the live " + string(thePlan.Element) + " " + thePlan.Name + ": " + err.Error())
+	}
+
+	thePlan.ResourceId = id
+	thePlan.live = live
+	thePlan.LiveHash, err = hashElement(live)
+	return live, err
+}
+
+//update adds the call to the plan if any of the fields differ between the live element and the backup
+func (p *RestorePlan) update(live interface{}, backup interface{}, operation string, input interface{}, fields ...string) error {
+	changed, err := p.compare(live, backup, fields...)
+	if err != nil || !changed {
+		return err
+	}
+	return p.addCall(operation, input)
+}
+
+//prepareInput fills in anything which shouldn't be written into a plan just before the call is made
+func (cr ConnectRestore) prepareInput(connectSvc *connect.Connect, input interface{}) error {
+
+	switch input.(type) {
+	case *connect.CreateUserInput:
+		newUser := input.(*connect.CreateUserInput)
+		if newUser.Password != nil {
+			return nil
+		}
+
+		result, err := connectSvc.DescribeInstance(&connect.DescribeInstanceInput{
+			InstanceId: newUser.InstanceId,
 		})
+		if err != nil {
+			return errors.New("could not describe the instance to create user " + *newUser.Username + " in: " + err.Error())
+		}
 
+		//Users of SAML and directory instances sign in through their identity provider and can't have a password
+		if aws.StringValue(result.Instance.IdentityManagementType) != connect.DirectoryTypeConnectManaged {
+			return nil
+		}
+
+		//The password is set to a very random long string.  Unless it is delivered somewhere it is never returned and
+		//the user will have to go through the password reset process.
+		res, err := password.Generate(64, 10, 10, false, false)
 		if err != nil {
-			log.Fatal("Could not Update User Routing Profile: " + err.Error())
+			return errors.New("could not generate new temporary password: " + err.Error())
 		}
 
-		if theUser.HierarchyGroupId != nil {
-			_, err = connectSvc.UpdateUserHierarchy(&connect.UpdateUserHierarchyInput{
-				InstanceId:       cr.ConnectInstanceId,
-				UserId:           theUser.Id,
-				HierarchyGroupId: theUser.HierarchyGroupId,
-			})
+		//Deliver the password before the user is created so it can't be lost
+		if cr.Credentials != nil {
+			err = cr.Credentials.store(*newUser.Username, res)
 			if err != nil {
-				log.Fatal("Could not Update User Hierarchy: " + err.Error())
+				return errors.New("could not deliver the initial password for " + *newUser.Username + ", the user was not created: " + err.Error())
 			}
-
 		}
-
+		newUser.Password = aws.String(res)
 	}
-	return err
+	return nil
 }
 
-func (cr ConnectRestore) restoreRoutingProfile() error {
+func sortStrings(values []*string) {
+	sort.Slice(values, func(i, j int) bool {
+		return *values[i] < *values[j]
+	})
+}
 
-	var theProfile connect.RoutingProfile
+func (cr ConnectRestore) planUser(connectSvc *connect.Connect) (*RestorePlan, error) {
+	var theUser connect.User
+
+	err := cr.readSource(&theUser)
+	if err != nil {
+		return nil, err
+	}
+
+	sourceId := aws.StringValue(theUser.Id)
+	err = cr.mapElement(&theUser, "Id", "Arn", "DirectoryUserId")
+	if err != nil {
+		return nil, err
+	}
 
-	cr.readSource(&theProfile)
+	thePlan := cr.newPlan(*theUser.Username)
+	thePlan.SourceId = sourceId
 
-	connectSvc := connect.New(&cr.Session)
-	var err error
-	//if we have a new flow name then we are creating a new routing profile with the backup, rather than restoring over the top of
-	//the old flow.
+	//if we have a new user name then we are creating a new user with the backup, rather than restoring over the top of
+	//the old user.
 	if cr.NewName != "" {
-		var newProfile connect.CreateRoutingProfileInput
-		awsutil.Copy(&newProfile, &theProfile)
-		newProfile.Name = aws.String(cr.NewName)
+		existing, err := cr.liveNames(connectSvc, Users)
+		if err != nil {
+			return nil, errors.New("could not check for an existing user " + cr.NewName + ": " + err.Error())
+		}
+
+		if id, found := existing[cr.NewName]; found {
+			if !cr.UpdateExisting {
+				return nil, errors.New("user " + cr.NewName + " already exists, restore with update in place enabled to update them instead")
+			}
+			log.Println("User " + cr.NewName + " already exists, updating them in place")
+			updateExisting := cr
+			updateExisting.NewName = ""
+			updateExisting.targetId = id
+			return updateExisting.planUser(connectSvc)
+		}
+	}
+
+	if cr.NewName != "" {
+		var newProfile connect.CreateUserInput
+		awsutil.Copy(&newProfile, &theUser)
+		newProfile.Username = aws.String(cr.NewName)
 		newProfile.InstanceId = cr.ConnectInstanceId
+		newProfile.DirectoryUserId = nil
 		newProfile.Tags = nil
 
-		result, err := connectSvc.CreateRoutingProfile(&newProfile)
+		thePlan.Name = cr.NewName
+		err = thePlan.addCall("CreateUser", &newProfile)
+		return &thePlan, err
+	}
 
-		if err != nil {
-			log.Fatal("Could not Create Routing Profile: " + err.Error())
-		}
+	//Update the existing user in place, this requires several operations.
+	if cr.targetId != "" {
+		theUser.Id = aws.String(cr.targetId)
+	}
+	live, err := cr.describeForPlan(connectSvc, &thePlan, *theUser.Id)
+	if err != nil {
+		return nil, err
+	}
+	liveUser := live.(connect.User)
+
+	err = thePlan.update(liveUser, theUser, "UpdateUserIdentityInfo", &connect.UpdateUserIdentityInfoInput{
+		InstanceId:   cr.ConnectInstanceId,
+		UserId:       theUser.Id,
+		IdentityInfo: theUser.IdentityInfo,
+	}, "IdentityInfo")
+	if err != nil {
+		return nil, err
+	}
 
-		cr.NewName = *result.RoutingProfileId
+	//The order of security profiles doesn't matter
+	sortStrings(liveUser.SecurityProfileIds)
+	sortStrings(theUser.SecurityProfileIds)
+	err = thePlan.update(liveUser, theUser, "UpdateUserSecurityProfiles", &connect.UpdateUserSecurityProfilesInput{
+		InstanceId:         cr.ConnectInstanceId,
+		UserId:             theUser.Id,
+		SecurityProfileIds: theUser.SecurityProfileIds,
+	}, "SecurityProfileIds")
+	if err != nil {
+		return nil, err
+	}
 
-	} else {
-		//Update the existing flow in place, this requires several operations.
+	err = thePlan.update(liveUser, theUser, "UpdateUserPhoneConfig", &connect.UpdateUserPhoneConfigInput{
+		InstanceId:  cr.ConnectInstanceId,
+		UserId:      theUser.Id,
+		PhoneConfig: theUser.PhoneConfig,
+	}, "PhoneConfig")
+	if err != nil {
+		return nil, err
+	}
 
-		//First update the profile name and description
-		_, err := connectSvc.UpdateRoutingProfileName(&connect.UpdateRoutingProfileNameInput{
-			RoutingProfileId: theProfile.RoutingProfileId,
-			InstanceId:       cr.ConnectInstanceId,
-			Name:             theProfile.Name,
-			Description:      theProfile.Description,
-		})
+	err = thePlan.update(liveUser, theUser, "UpdateUserRoutingProfile", &connect.UpdateUserRoutingProfileInput{
+		InstanceId:       cr.ConnectInstanceId,
+		UserId:           theUser.Id,
+		RoutingProfileId: theUser.RoutingProfileId,
+	}, "RoutingProfileId")
+	if err != nil {
+		return nil, err
+	}
 
+	//The API won't accept an empty hierarchy group
+	if theUser.HierarchyGroupId != nil {
+		err = thePlan.update(liveUser, theUser, "UpdateUserHierarchy", &connect.UpdateUserHierarchyInput{
+			InstanceId:       cr.ConnectInstanceId,
+			UserId:           theUser.Id,
+			HierarchyGroupId: theUser.HierarchyGroupId,
+		}, "HierarchyGroupId")
 		if err != nil {
-			log.Fatal("Could not Update Routing Profile Name: " + err.Error())
+			return nil, err
 		}
+	}
 
-		//Then the concurrency
-		_, err = connectSvc.UpdateRoutingProfileConcurrency(&connect.UpdateRoutingProfileConcurrencyInput{
-			RoutingProfileId:   theProfile.RoutingProfileId,
-			InstanceId:         cr.ConnectInstanceId,
-			MediaConcurrencies: theProfile.MediaConcurrencies,
-		})
+	return &thePlan, nil
+}
+
+func (cr ConnectRestore) planRoutingProfile(connectSvc *connect.Connect) (*RestorePlan, error) {
+
+	reader, element, err := cr.open()
+	if err != nil {
+		return nil, err
+	}
+
+	var theProfile connect.RoutingProfile
+	err = readElement(reader, element, cr.Source, &theProfile)
+	if err != nil {
+		return nil, err
+	}
+
+	//the queue config is stored against the source routing profile id
+	sourceProfileId := *theProfile.RoutingProfileId
+
+	err = cr.mapElement(&theProfile, "RoutingProfileId", "RoutingProfileArn")
+	if err != nil {
+		return nil, err
+	}
 
+	//the queues are read from the backup the routing profile was read from
+	queueReader := reader
+	if versioned, ok := reader.(alongsideReader); ok {
+		queueReader, err = versioned.alongside(element)
 		if err != nil {
-			log.Fatal("Could not Update Routing Profile Concurrency: " + err.Error())
+			return nil, err
 		}
+	}
 
-		//Now the default outbound queue
-		//First update the flow name
-		_, err = connectSvc.UpdateRoutingProfileDefaultOutboundQueue(&connect.UpdateRoutingProfileDefaultOutboundQueueInput{
-			RoutingProfileId:       theProfile.RoutingProfileId,
-			InstanceId:             cr.ConnectInstanceId,
-			DefaultOutboundQueueId: theProfile.DefaultOutboundQueueId,
-		})
+	theProfileQueueConfig := make([]connect.RoutingProfileQueueConfigSummary, 0)
+	err = readElement(queueReader, Element{Type: RoutingProfileQueues, Name: sourceProfileId}, cr.Source, &theProfileQueueConfig)
+	if err != nil {
+		return nil, err
+	}
 
-		if err != nil {
-			log.Fatal("Could not Update Routing Profile Default outbound Queue: " + err.Error())
+	err = cr.mapElement(&theProfileQueueConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var queueConfigs []*connect.RoutingProfileQueueConfig
+	for _, v := range theProfileQueueConfig {
+		queueConfigs = append(queueConfigs, queueConfig(v))
+	}
+
+	thePlan := cr.newPlan(*theProfile.Name)
+	thePlan.SourceId = sourceProfileId
+
+	//if we have a new routing profile name then we are creating a new routing profile with the backup, rather than
+	//restoring over the top of the old one.
+	if cr.NewName != "" {
+		var newProfile connect.CreateRoutingProfileInput
+		awsutil.Copy(&newProfile, &theProfile)
+		newProfile.Name = aws.String(cr.NewName)
+		newProfile.InstanceId = cr.ConnectInstanceId
+		newProfile.Tags = nil
+
+		//Only so many queues can be passed when creating the routing profile, the rest are associated with it once it
+		//has been created.  The id of the new routing profile is filled in when the plan is executed.
+		batches := queueBatches(queueConfigs)
+		if len(batches) > 0 {
+			newProfile.QueueConfigs = batches[0]
 		}
 
-		cr.NewName = *theProfile.RoutingProfileId
-		if cr.location == fileSource {
-			cr.Source = filepath.Dir(filepath.Dir(cr.Source)) + string(os.PathSeparator) + string(RoutingProfileQueues) + "s/" + *theProfile.RoutingProfileId + jsonExtn
-		} else {
-			newPath := filepath.Dir(filepath.Dir(cr.url.Path)) + string(RoutingProfileQueues) + "s/" + *theProfile.RoutingProfileId + jsonExtn
-			cr.Source = "s3://" + cr.url.Host + newPath
+		thePlan.Name = cr.NewName
+		err = thePlan.addCall("CreateRoutingProfile", &newProfile)
+		for i := 1; i < len(batches) && err == nil; i++ {
+			err = thePlan.addCall("AssociateRoutingProfileQueues", &connect.AssociateRoutingProfileQueuesInput{
+				InstanceId:   cr.ConnectInstanceId,
+				QueueConfigs: batches[i],
+			})
 		}
+		return &thePlan, err
+	}
 
+	//Update the existing routing profile in place, this requires several operations.
+	if cr.targetId != "" {
+		theProfile.RoutingProfileId = aws.String(cr.targetId)
+	}
+	live, err := cr.describeForPlan(connectSvc, &thePlan, *theProfile.RoutingProfileId)
+	if err != nil {
+		return nil, err
 	}
+	liveProfile := live.(liveRoutingProfile)
 
-	err = cr.restoreRoutingProfileQueue(connectSvc)
+	//The order of the channels doesn't matter
+	sortConcurrencies(liveProfile.RoutingProfile.MediaConcurrencies)
+	sortConcurrencies(theProfile.MediaConcurrencies)
 
-	return err
-}
+	//First update the profile name and description
+	err = thePlan.update(liveProfile.RoutingProfile, theProfile, "UpdateRoutingProfileName", &connect.UpdateRoutingProfileNameInput{
+		RoutingProfileId: theProfile.RoutingProfileId,
+		InstanceId:       cr.ConnectInstanceId,
+		Name:             theProfile.Name,
+		Description:      theProfile.Description,
+	}, "Name", "Description")
+	if err != nil {
+		return nil, err
+	}
 
-func (cr ConnectRestore) restoreRoutingProfileQueue(connectSvc *connect.Connect) error {
+	//Then the concurrency
+	err = thePlan.update(liveProfile.RoutingProfile, theProfile, "UpdateRoutingProfileConcurrency", &connect.UpdateRoutingProfileConcurrencyInput{
+		RoutingProfileId:   theProfile.RoutingProfileId,
+		InstanceId:         cr.ConnectInstanceId,
+		MediaConcurrencies: theProfile.MediaConcurrencies,
+	}, "MediaConcurrencies")
+	if err != nil {
+		return nil, err
+	}
 
-	theProfileQueueConfig := make([]connect.RoutingProfileQueueConfigSummary, 0)
+	//Now the default outbound queue
+	err = thePlan.update(liveProfile.RoutingProfile, theProfile, "UpdateRoutingProfileDefaultOutboundQueue", &connect.UpdateRoutingProfileDefaultOutboundQueueInput{
+		RoutingProfileId:       theProfile.RoutingProfileId,
+		InstanceId:             cr.ConnectInstanceId,
+		DefaultOutboundQueueId: theProfile.DefaultOutboundQueueId,
+	}, "DefaultOutboundQueueId")
+	if err != nil {
+		return nil, err
+	}
 
-	cr.readSource(&theProfileQueueConfig)
+	err = cr.planRoutingProfileQueues(&thePlan, *theProfile.RoutingProfileId, liveProfile.Queues, theProfileQueueConfig)
 
-	var err error
+	return &thePlan, err
+}
 
-	var queueConfigs []*connect.RoutingProfileQueueConfig
+func sortConcurrencies(concurrencies []*connect.MediaConcurrency) {
+	sort.Slice(concurrencies, func(i, j int) bool {
+		return *concurrencies[i].Channel < *concurrencies[j].Channel
+	})
+}
 
-	for _, v := range theProfileQueueConfig {
-		queueConfigs = append(queueConfigs, &connect.RoutingProfileQueueConfig{
-			Priority: v.Priority,
-			Delay:    v.Delay,
-			QueueReference: &connect.RoutingProfileQueueReference{
-				QueueId: v.QueueId,
-				Channel: v.Channel,
-			},
-		})
+func queueConfig(summary connect.RoutingProfileQueueConfigSummary) *connect.RoutingProfileQueueConfig {
+	return &connect.RoutingProfileQueueConfig{
+		Priority: summary.Priority,
+		Delay:    summary.Delay,
+		QueueReference: &connect.RoutingProfileQueueReference{
+			QueueId: summary.QueueId,
+			Channel: summary.Channel,
+		},
 	}
+}
 
-	//For routing profiel queues if there queue is not associated you must associate it.  If it's associated then you
-	//must update it.  We just use brute force here and call both
-	associateQueueProfile := connect.AssociateRoutingProfileQueuesInput{
-		RoutingProfileId: aws.String(cr.NewName),
-		InstanceId:       cr.ConnectInstanceId,
-		QueueConfigs:     queueConfigs,
+//The most queues that can be associated, updated or disassociated in a single call
+const routingProfileQueueBatch = 10
+
+//queueBatches splits queue configs into batches the API will accept
+func queueBatches(configs []*connect.RoutingProfileQueueConfig) [][]*connect.RoutingProfileQueueConfig {
+	var batches [][]*connect.RoutingProfileQueueConfig
+	for len(configs) > routingProfileQueueBatch {
+		batches = append(batches, configs[:routingProfileQueueBatch])
+		configs = configs[routingProfileQueueBatch:]
 	}
+	if len(configs) > 0 {
+		batches = append(batches, configs)
+	}
+	return batches
+}
 
-	_, err = connectSvc.AssociateRoutingProfileQueues(&associateQueueProfile)
+//planRoutingProfileQueues reconciles the queues of a live routing profile with the backup.  Queues which are only in
+//the backup are associated, those whose priority or delay differ are updated and those which aren't in the backup are
+//disassociated.  They are disassociated last so the routing profile is never left without its queues part way through.
+func (cr ConnectRestore) planRoutingProfileQueues(thePlan *RestorePlan, routingProfileId string, live []*connect.RoutingProfileQueueConfigSummary, backup []connect.RoutingProfileQueueConfigSummary) error {
 
-	updateQueueProfile := connect.UpdateRoutingProfileQueuesInput{
-		RoutingProfileId: aws.String(cr.NewName),
-		InstanceId:       cr.ConnectInstanceId,
-		QueueConfigs:     queueConfigs,
+	liveQueues := make(map[string]*connect.RoutingProfileQueueConfigSummary)
+	for _, v := range live {
+		liveQueues[*v.QueueId+"/"+*v.Channel] = v
 	}
-	//First update the flow name
 
-	_, err = connectSvc.UpdateRoutingProfileQueues(&updateQueueProfile)
-	return err
-}
+	var associate, update []*connect.RoutingProfileQueueConfig
+	inBackup := make(map[string]bool)
+	for _, v := range backup {
+		key := *v.QueueId + "/" + *v.Channel
+		inBackup[key] = true
+
+		name := "Queues[" + aws.StringValue(v.QueueName) + " " + *v.Channel + "]"
+		liveQueue, found := liveQueues[key]
+		if !found {
+			thePlan.Changes = append(thePlan.Changes, FieldChange{Field: name, Backup: queueConfig(v)})
+			associate = append(associate, queueConfig(v))
+			continue
+		}
 
-func (cr ConnectRestore) readSource(destination interface{}) {
-	s3Location, _ := url.Parse(cr.Source)
-	if s3Location.Scheme == "s3" {
-		cr.location = s3Source
-		cr.url = *s3Location
-		var stream io.ReadCloser
-		s3Svc := s3.New(&cr.Session)
+		changes := diffTree(name+".Priority", float64(*liveQueue.Priority), float64(*v.Priority))
+		changes = append(changes, diffTree(name+".Delay", float64(*liveQueue.Delay), float64(*v.Delay))...)
+		if len(changes) > 0 {
+			thePlan.Changes = append(thePlan.Changes, changes...)
+			update = append(update, queueConfig(v))
+		}
+	}
 
-		result, err := s3Svc.GetObject(&s3.GetObjectInput{
-			Bucket: aws.String(s3Location.Host),
-			Key:    aws.String(s3Location.Path),
-		})
+	var disassociate []*connect.RoutingProfileQueueConfig
+	for _, v := range live {
+		if inBackup[*v.QueueId+"/"+*v.Channel] {
+			continue
+		}
+		name := "Queues[" + aws.StringValue(v.QueueName) + " " + *v.Channel + "]"
+		thePlan.Changes = append(thePlan.Changes, FieldChange{Field: name, Live: queueConfig(*v)})
+		disassociate = append(disassociate, queueConfig(*v))
+	}
 
+	for _, v := range queueBatches(associate) {
+		err := thePlan.addCall("AssociateRoutingProfileQueues", &connect.AssociateRoutingProfileQueuesInput{
+			RoutingProfileId: aws.String(routingProfileId),
+			InstanceId:       cr.ConnectInstanceId,
+			QueueConfigs:     v,
+		})
 		if err != nil {
-			log.Fatal("Could not read source from S3: " + err.Error())
+			return err
 		}
-		stream = result.Body
-		err = jsonutil.UnmarshalJSON(destination, stream)
+	}
+
+	for _, v := range queueBatches(update) {
+		err := thePlan.addCall("UpdateRoutingProfileQueues", &connect.UpdateRoutingProfileQueuesInput{
+			RoutingProfileId: aws.String(routingProfileId),
+			InstanceId:       cr.ConnectInstanceId,
+			QueueConfigs:     v,
+		})
 		if err != nil {
-			log.Fatal("Could not unmarshal json source: " + err.Error())
+			return err
 		}
-	} else {
-		cr.location = fileSource
-		//Assume it's a file, try opening it
-		fileByte, err := ioutil.ReadFile(cr.Source)
-		if err != nil {
-			log.Fatal("Could not read source from file: " + err.Error())
+	}
+
+	for _, v := range queueBatches(disassociate) {
+		var references []*connect.RoutingProfileQueueReference
+		for _, config := range v {
+			references = append(references, config.QueueReference)
 		}
-		err = json.Unmarshal(fileByte, destination)
+		err := thePlan.addCall("DisassociateRoutingProfileQueues", &connect.DisassociateRoutingProfileQueuesInput{
+			RoutingProfileId: aws.String(routingProfileId),
+			InstanceId:       cr.ConnectInstanceId,
+			QueueReferences:  references,
+		})
 		if err != nil {
-			log.Fatal("Could not unmarshal json source: " + err.Error())
+			return err
 		}
 	}
+	return nil
+}
+
+//mapElement applies the restore mapping, if there is one, to an element read from the source.  The elements own
+//identifying fields are only mapped when restoring over the top of the existing element with the same id.
+func (cr ConnectRestore) mapElement(element interface{}, ownFields ...string) error {
+	if cr.Mapping == nil {
+		return nil
+	}
+	if cr.NewName == "" && cr.targetId == "" {
+		ownFields = nil
+	}
+	return cr.Mapping.apply(element, ownFields...)
+}
+
+//open works out the reader and element to restore from
+func (cr ConnectRestore) open() (Reader, Element, error) {
+	if cr.Reader != nil {
+		return cr.decrypting(cr.Reader), Element{Type: cr.Element, Name: cr.Name}, nil
+	}
+
+	reader, element, err := openSource(cr.Source, &cr.Session, cr.VersionId, cr.AsOf)
+	if err != nil {
+		return nil, element, err
+	}
+	if _, ok := reader.(*StdinReader); ok {
+		element = Element{Type: cr.Element, Name: cr.Name}
+	}
+	return cr.decrypting(reader), element, nil
+}
+
+//decrypting wraps the reader so that encrypted backups are decrypted as they are read
+func (cr ConnectRestore) decrypting(reader Reader) Reader {
+	return &DecryptingReader{
+		Reader: reader,
+		Sess:   &cr.Session,
+		Keys:   cr.Keys,
+		source: cr.sourceKey,
+	}
+}
+
+func (cr ConnectRestore) readSource(destination interface{}) error {
+	reader, element, err := cr.open()
+	if err != nil {
+		return err
+	}
+	return readElement(reader, element, cr.Source, destination)
+}
+
+//readElement reads an element through a reader and decodes it into destination
+func readElement(reader Reader, element Element, source string, destination interface{}) error {
+	document, err := reader.Read(element)
+	if err != nil {
+		return errors.New("could not read " + source + ": " + err.Error())
+	}
+
+	err = unmarshalElement(document, destination)
+	if err != nil {
+		return errors.New("could not unmarshal json source " + source + ": " + err.Error())
+	}
+	return nil
+}
 
+//unmarshalElement decodes an element written by a backup, in json or yaml.  jsonutil reads the timestamps the backup
+//writes, but can only decode into a struct, so lists are decoded with encoding/json.
+func unmarshalElement(doc []byte, destination interface{}) error {
+	doc, err := documentJSON(doc)
+	if err != nil {
+		return err
+	}
+	if reflect.TypeOf(destination).Elem().Kind() == reflect.Struct {
+		return jsonutil.UnmarshalJSON(destination, bytes.NewReader(doc))
+	}
+	return json.Unmarshal(doc, destination)
 }
 
 //func (cr ConnectRestore) checkSourceConnectInstance(sourceArn string) bool {
@@ -372,21 +988,26 @@ func (cr ConnectRestore) readSource(destination interface{}) {
 //	return found
 //}
 
-func (cr ConnectRestore) restoreFlow() error {
+func (cr ConnectRestore) planFlow(connectSvc *connect.Connect) (*RestorePlan, error) {
 
-	//is the location S3 or file?
 	var theFlow connect.ContactFlow
 
-	cr.readSource(&theFlow)
+	err := cr.readSource(&theFlow)
+	if err != nil {
+		return nil, err
+	}
+
+	sourceId := aws.StringValue(theFlow.Id)
+	err = cr.mapElement(&theFlow, "Id", "Arn")
+	if err != nil {
+		return nil, err
+	}
 
-	var err error = nil
 	cr.sourceArn, err = arn.Parse(*theFlow.Arn)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	connectSvc := connect.New(&cr.Session)
-
 	//Check to see if the source is from the same connect account, instance or region.
 	//if !cr.checkSourceConnectInstance(*theFlow.Arn) {
 	//	//the source is from a different connect account, instance or region to the destination.  The flow can only be
@@ -395,6 +1016,9 @@ func (cr ConnectRestore) restoreFlow() error {
 	//
 	//}
 
+	thePlan := cr.newPlan(*theFlow.Name)
+	thePlan.SourceId = sourceId
+
 	//if we have a new flow name then we are creating a new flow with the backup, rather than restoring over the top of
 	//the old flow.
 	if cr.NewName != "" {
@@ -404,20 +1028,186 @@ func (cr ConnectRestore) restoreFlow() error {
 		newFlow.InstanceId = cr.ConnectInstanceId
 		newFlow.Tags = nil
 
-		_, err = connectSvc.CreateContactFlow(&newFlow)
+		thePlan.Name = cr.NewName
+		err = thePlan.addCall("CreateContactFlow", &newFlow)
+		return &thePlan, err
+	}
 
-	} else {
+	if cr.targetId != "" {
+		theFlow.Id = aws.String(cr.targetId)
+	}
+	live, err := cr.describeForPlan(connectSvc, &thePlan, *theFlow.Id)
+	if err != nil {
+		return nil, err
+	}
 
-		_, err = connectSvc.UpdateContactFlowContent(&connect.UpdateContactFlowContentInput{
-			ContactFlowId: theFlow.Id,
-			Content:       theFlow.Content,
-			InstanceId:    cr.ConnectInstanceId,
-		})
+	err = thePlan.update(live, theFlow, "UpdateContactFlowContent", &connect.UpdateContactFlowContentInput{
+		ContactFlowId: theFlow.Id,
+		Content:       theFlow.Content,
+		InstanceId:    cr.ConnectInstanceId,
+	}, "Content")
+
+	return &thePlan, err
+}
+
+func (cr ConnectRestore) planHoursOfOperation(connectSvc *connect.Connect) (*RestorePlan, error) {
+
+	var theHours connect.HoursOfOperation
+
+	err := cr.readSource(&theHours)
+	if err != nil {
+		return nil, err
 	}
 
+	sourceId := aws.StringValue(theHours.HoursOfOperationId)
+	err = cr.mapElement(&theHours, "HoursOfOperationId", "HoursOfOperationArn")
 	if err != nil {
-		log.Fatal("Could not restore Contact Flow: " + err.Error())
+		return nil, err
 	}
 
-	return err
+	thePlan := cr.newPlan(*theHours.Name)
+	thePlan.SourceId = sourceId
+
+	if cr.NewName != "" {
+		var newHours connect.CreateHoursOfOperationInput
+		awsutil.Copy(&newHours, &theHours)
+		newHours.Name = aws.String(cr.NewName)
+		newHours.InstanceId = cr.ConnectInstanceId
+		newHours.Tags = nil
+
+		thePlan.Name = cr.NewName
+		err = thePlan.addCall("CreateHoursOfOperation", &newHours)
+		return &thePlan, err
+	}
+
+	if cr.targetId != "" {
+		theHours.HoursOfOperationId = aws.String(cr.targetId)
+	}
+	live, err := cr.describeForPlan(connectSvc, &thePlan, *theHours.HoursOfOperationId)
+	if err != nil {
+		return nil, err
+	}
+	liveHours := live.(connect.HoursOfOperation)
+
+	//The order of the days doesn't matter
+	sortHoursConfig(liveHours.Config)
+	sortHoursConfig(theHours.Config)
+
+	//Hours of operation are updated in a single call
+	err = thePlan.update(liveHours, theHours, "UpdateHoursOfOperation", &connect.UpdateHoursOfOperationInput{
+		HoursOfOperationId: theHours.HoursOfOperationId,
+		InstanceId:         cr.ConnectInstanceId,
+		Name:               theHours.Name,
+		Description:        theHours.Description,
+		TimeZone:           theHours.TimeZone,
+		Config:             theHours.Config,
+	}, "Name", "Description", "TimeZone", "Config")
+
+	return &thePlan, err
+}
+
+func sortHoursConfig(config []*connect.HoursOfOperationConfig) {
+	sort.Slice(config, func(i, j int) bool {
+		if *config[i].Day == *config[j].Day {
+			return *config[i].StartTime.Hours*60+*config[i].StartTime.Minutes < *config[j].StartTime.Hours*60+*config[j].StartTime.Minutes
+		}
+		return *config[i].Day < *config[j].Day
+	})
+}
+
+func (cr ConnectRestore) planQueue(connectSvc *connect.Connect) (*RestorePlan, error) {
+
+	var theQueue connect.Queue
+
+	err := cr.readSource(&theQueue)
+	if err != nil {
+		return nil, err
+	}
+
+	sourceId := aws.StringValue(theQueue.QueueId)
+	err = cr.mapElement(&theQueue, "QueueId", "QueueArn")
+	if err != nil {
+		return nil, err
+	}
+
+	thePlan := cr.newPlan(*theQueue.Name)
+	thePlan.SourceId = sourceId
+
+	if cr.NewName != "" {
+		var newQueue connect.CreateQueueInput
+		awsutil.Copy(&newQueue, &theQueue)
+		newQueue.Name = aws.String(cr.NewName)
+		newQueue.InstanceId = cr.ConnectInstanceId
+		newQueue.Tags = nil
+
+		thePlan.Name = cr.NewName
+		err = thePlan.addCall("CreateQueue", &newQueue)
+
+		//A queue is always created enabled, one disabled in the backup is disabled once it has been created.  The id of
+		//the new queue is filled in when the plan is executed.
+		if err == nil && aws.StringValue(theQueue.Status) == connect.QueueStatusDisabled {
+			err = thePlan.addCall("UpdateQueueStatus", &connect.UpdateQueueStatusInput{
+				InstanceId: cr.ConnectInstanceId,
+				Status:     theQueue.Status,
+			})
+		}
+		return &thePlan, err
+	}
+
+	//Update the existing queue in place, this requires several operations.
+	if cr.targetId != "" {
+		theQueue.QueueId = aws.String(cr.targetId)
+	}
+	live, err := cr.describeForPlan(connectSvc, &thePlan, *theQueue.QueueId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = thePlan.update(live, theQueue, "UpdateQueueName", &connect.UpdateQueueNameInput{
+		QueueId:     theQueue.QueueId,
+		InstanceId:  cr.ConnectInstanceId,
+		Name:        theQueue.Name,
+		Description: theQueue.Description,
+	}, "Name", "Description")
+	if err != nil {
+		return nil, err
+	}
+
+	err = thePlan.update(live, theQueue, "UpdateQueueHoursOfOperation", &connect.UpdateQueueHoursOfOperationInput{
+		QueueId:            theQueue.QueueId,
+		InstanceId:         cr.ConnectInstanceId,
+		HoursOfOperationId: theQueue.HoursOfOperationId,
+	}, "HoursOfOperationId")
+	if err != nil {
+		return nil, err
+	}
+
+	err = thePlan.update(live, theQueue, "UpdateQueueMaxContacts", &connect.UpdateQueueMaxContactsInput{
+		QueueId:     theQueue.QueueId,
+		InstanceId:  cr.ConnectInstanceId,
+		MaxContacts: theQueue.MaxContacts,
+	}, "MaxContacts")
+	if err != nil {
+		return nil, err
+	}
+
+	//The API won't accept an empty outbound caller config
+	if theQueue.OutboundCallerConfig != nil {
+		err = thePlan.update(live, theQueue, "UpdateQueueOutboundCallerConfig", &connect.UpdateQueueOutboundCallerConfigInput{
+			QueueId:              theQueue.QueueId,
+			InstanceId:           cr.ConnectInstanceId,
+			OutboundCallerConfig: theQueue.OutboundCallerConfig,
+		}, "OutboundCallerConfig")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = thePlan.update(live, theQueue, "UpdateQueueStatus", &connect.UpdateQueueStatusInput{
+		QueueId:    theQueue.QueueId,
+		InstanceId: cr.ConnectInstanceId,
+		Status:     theQueue.Status,
+	}, "Status")
+
+	return &thePlan, err
 }
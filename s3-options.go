@@ -0,0 +1,173 @@
+package connect_backup
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//The header S3 checks the bucket owner against
+const expectedBucketOwnerHeader = "X-Amz-Expected-Bucket-Owner"
+
+//S3Options are the settings backups are written to, and read from, S3 with
+type S3Options struct {
+	//KMSKeyId encrypts the objects written with SSE-KMS under this key rather than the bucket's default encryption
+	KMSKeyId string
+	//StorageClass is the storage class of the objects written, e.g. STANDARD_IA
+	StorageClass string
+	//Tags are added to every object written
+	Tags map[string]string
+	//ExpectedBucketOwner is the account the bucket must belong to, so a backup is never written to or read from a
+	//bucket someone else owns
+	ExpectedBucketOwner string
+	//Endpoint sends S3 requests somewhere other than AWS, such as MinIO, LocalStack or an on-premises S3 store
+	Endpoint string
+	//PathStyle puts the bucket in the path of the URL rather than the host, which most S3 compatible stores need
+	PathStyle bool
+	//ObjectLockMode is the Object Lock retention mode, GOVERNANCE or COMPLIANCE, of the objects written.  The bucket
+	//must have Object Lock enabled.
+	ObjectLockMode string
+	//ObjectLockDays is how many days from when each object is written it is retained for
+	ObjectLockDays int
+	//LegalHold places a legal hold on the objects written, which keeps them until it is removed whatever their
+	//retention
+	LegalHold bool
+}
+
+//Session returns a copy of the session which sends S3 requests to the Endpoint, using path-style addressing if set,
+//and checks the owner of every bucket used.  Requests to other services are unchanged.
+func (o S3Options) Session(sess *session.Session) *session.Session {
+
+	config := &aws.Config{}
+	if o.PathStyle {
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	if o.Endpoint != "" {
+		endpoint := o.Endpoint
+		config.EndpointResolver = endpoints.ResolverFunc(func(service string, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+			if service == s3.EndpointsID {
+				return endpoints.ResolvedEndpoint{
+					URL:           endpoint,
+					SigningRegion: region,
+				}, nil
+			}
+			return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+		})
+	}
+
+	copied := sess.Copy(config)
+	if o.ExpectedBucketOwner != "" {
+		owner := o.ExpectedBucketOwner
+		copied.Handlers.Build.PushBack(func(r *request.Request) {
+			if r.ClientInfo.ServiceName == s3.ServiceName && r.HTTPRequest.Header.Get(expectedBucketOwnerHeader) == "" {
+				r.HTTPRequest.Header.Set(expectedBucketOwnerHeader, owner)
+			}
+		})
+	}
+	return copied
+}
+
+//tagging encodes the tags the way S3 expects them when an object is written
+func (o S3Options) tagging() *string {
+	if len(o.Tags) == 0 {
+		return nil
+	}
+
+	var keys []string
+	for k := range o.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tags := url.Values{}
+	for _, k := range keys {
+		tags.Add(k, o.Tags[k])
+	}
+	return aws.String(tags.Encode())
+}
+
+//optional returns nil for an option which isn't set, so it is left out of the request
+func optional(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return aws.String(value)
+}
+
+//putObject fills in the options of an object about to be written
+func (o S3Options) putObject(input *s3.PutObjectInput) *s3.PutObjectInput {
+	if o.KMSKeyId != "" {
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		input.SSEKMSKeyId = aws.String(o.KMSKeyId)
+	}
+	input.StorageClass = optional(o.StorageClass)
+	input.Tagging = o.tagging()
+	input.ExpectedBucketOwner = optional(o.ExpectedBucketOwner)
+
+	if o.locking() {
+		if o.ObjectLockMode != "" {
+			input.ObjectLockMode = aws.String(o.ObjectLockMode)
+			input.ObjectLockRetainUntilDate = aws.Time(time.Now().UTC().AddDate(0, 0, o.ObjectLockDays))
+		}
+		if o.LegalHold {
+			input.ObjectLockLegalHoldStatus = aws.String(s3.ObjectLockLegalHoldStatusOn)
+		}
+		//S3 refuses locked objects without an MD5 of the body
+		hash := md5.New()
+		if _, err := io.Copy(hash, input.Body); err == nil {
+			input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(hash.Sum(nil)))
+		}
+		_, _ = input.Body.Seek(0, io.SeekStart)
+	}
+	return input
+}
+
+//locking is whether the objects written are retained or held with Object Lock
+func (o S3Options) locking() bool {
+	return o.ObjectLockMode != "" || o.LegalHold
+}
+
+//checkObjectLock checks the Object Lock options make sense and that the bucket has Object Lock enabled, as S3 would
+//otherwise refuse every object written
+func (o S3Options) checkObjectLock(svc *s3.S3, bucket string) error {
+	if o.ObjectLockMode != "" {
+		if o.ObjectLockMode != s3.ObjectLockModeGovernance && o.ObjectLockMode != s3.ObjectLockModeCompliance {
+			return errors.New("the Object Lock mode must be " + s3.ObjectLockModeGovernance + " or " + s3.ObjectLockModeCompliance + ", not " + o.ObjectLockMode)
+		}
+		if o.ObjectLockDays <= 0 {
+			return errors.New("an Object Lock mode needs the number of days to retain objects for")
+		}
+	} else if o.ObjectLockDays > 0 {
+		return errors.New("the " + strconv.Itoa(o.ObjectLockDays) + " days to retain objects for needs an Object Lock mode")
+	}
+	if !o.locking() {
+		return nil
+	}
+
+	result, err := svc.GetObjectLockConfiguration(&s3.GetObjectLockConfigurationInput{
+		Bucket:              aws.String(bucket),
+		ExpectedBucketOwner: optional(o.ExpectedBucketOwner),
+	})
+	if failure, ok := err.(awserr.Error); ok && failure.Code() == "ObjectLockConfigurationNotFoundError" {
+		return errors.New("the bucket " + bucket + " does not have Object Lock enabled, which can only be turned on when the bucket is created or by AWS support")
+	}
+	if err != nil {
+		return errors.New("could not check the bucket " + bucket + " has Object Lock enabled: " + err.Error())
+	}
+	if result.ObjectLockConfiguration == nil || aws.StringValue(result.ObjectLockConfiguration.ObjectLockEnabled) != s3.ObjectLockEnabledEnabled {
+		return errors.New("the bucket " + bucket + " does not have Object Lock enabled, which can only be turned on when the bucket is created or by AWS support")
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package connect_backup
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+//The name of the marker in an instance directory or prefix naming its latest snapshot
+const latestMarker = "latest"
+
+//BackupSnapshot is a single timestamped backup of an instance
+type BackupSnapshot struct {
+	Instance  string
+	Timestamp time.Time
+	Location  string
+	Elements  int
+	Latest    bool
+}
+
+//Snapshots finds every snapshot under a local directory, S3 prefix or archive, oldest first for each instance
+func Snapshots(sess *session.Session, root string) ([]BackupSnapshot, error) {
+
+	cr := ConnectRestore{
+		Session: *sess,
+	}
+	objects, markers, err := cr.listAll(root)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]*BackupSnapshot)
+	for _, v := range objects {
+		if v.snapshot == "" {
+			continue
+		}
+
+		key := v.instance + "/" + v.snapshot
+		snapshot, ok := found[key]
+		if !ok {
+			timestamp, _ := time.Parse(time.RFC3339, v.snapshot)
+			snapshot = &BackupSnapshot{
+				Instance:  v.instance,
+				Timestamp: timestamp,
+				Location:  v.location[:strings.Index(v.location, v.snapshot)+len(v.snapshot)],
+				Latest:    markers[v.instance] == v.snapshot,
+			}
+			found[key] = snapshot
+		}
+		snapshot.Elements++
+	}
+
+	var snapshots []BackupSnapshot
+	for _, v := range found {
+		snapshots = append(snapshots, *v)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		if snapshots[i].Instance == snapshots[j].Instance {
+			return snapshots[i].Timestamp.Before(snapshots[j].Timestamp)
+		}
+		return snapshots[i].Instance < snapshots[j].Instance
+	})
+	return snapshots, nil
+}
+
+//ListSnapshots prints the snapshots under the root with the number of elements in each, marking the latest
+func ListSnapshots(sess *session.Session, root string, out io.Writer) error {
+
+	snapshots, err := Snapshots(sess, root)
+	if err != nil {
+		return err
+	}
+
+	if len(snapshots) == 0 {
+		fmt.Fprintln(out, "No snapshots found under "+root)
+		return nil
+	}
+
+	instance := ""
+	for _, v := range snapshots {
+		if v.Instance != instance {
+			instance = v.Instance
+			fmt.Fprintln(out, instance+":")
+		}
+		latest := ""
+		if v.Latest {
+			latest = "  (latest)"
+		}
+		fmt.Fprintf(out, "  %s  %5d elements  %s%s\n", v.Timestamp.Format(time.RFC3339), v.Elements, v.Location, latest)
+	}
+	return nil
+}
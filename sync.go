@@ -0,0 +1,346 @@
+package connect_backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/connect"
+)
+
+//The elements a sync converges, in the order they are synced.  Elements are synced before those which usually refer
+//to them.
+var syncElements = []ConnectElement{HoursOfOperation, Queues, Flows, RoutingProfiles, Users}
+
+//SyncResult is what a sync did for one type of element
+type SyncResult struct {
+	Element   ConnectElement
+	Created   []string
+	Updated   []string
+	Unchanged []string
+	Deleted   []string
+	Failed    map[string]error
+}
+
+//syncItem is a single element of the backup waiting to be synced
+type syncItem struct {
+	object backupObject
+	result *SyncResult
+}
+
+//Sync treats the backup in the Source directory or S3 prefix as the desired state of the instance.  Every hours of
+//operation, queue, flow, routing profile and user in the backup is matched to the live element with the same name, or
+//the name it is mapped to.  Those which differ are updated and those which are missing are created.  Live elements
+//which aren't in the backup are only deleted if deleteMissing is set, and only if every element of the backup was
+//synced.  Once an instance matches the backup, syncing again makes no changes.
+//
+//Elements can refer to each other in either direction, e.g. a queue to its outbound whisper flow and a flow to the
+//queue it transfers to, so elements which fail are tried again for as long as each pass gets more of them done.  With
+//a Mapping, the ids of the elements synced are added to it as they are learnt so later elements referring to them can
+//be mapped.
+func (cr ConnectRestore) Sync(deleteMissing bool) ([]SyncResult, error) {
+
+	objects, err := cr.listBackup(cr.Source)
+	if err != nil {
+		return nil, errors.New("could not list " + cr.Source + ": " + err.Error())
+	}
+
+	connectSvc := connect.New(&cr.Session)
+
+	results := make([]SyncResult, len(syncElements))
+	var pending []syncItem
+	for i, element := range syncElements {
+		results[i] = SyncResult{
+			Element: element,
+			Failed:  make(map[string]error),
+		}
+		for _, v := range objects {
+			if v.element == element {
+				pending = append(pending, syncItem{object: v, result: &results[i]})
+			}
+		}
+	}
+
+	for pass := 1; len(pending) > 0; pass++ {
+		log.Printf("Sync pass %d, %d elements to sync\n", pass, len(pending))
+
+		var retry []syncItem
+		failed := make(map[*syncItem]error)
+		live := make(map[ConnectElement]map[string]string)
+		for i, v := range pending {
+			element := v.result.Element
+			if live[element] == nil {
+				live[element], err = cr.liveNames(connectSvc, element)
+				if err != nil {
+					return results, errors.New("could not list the live " + string(element) + ": " + err.Error())
+				}
+			}
+
+			created, err := cr.syncElement(connectSvc, v, live[element])
+			if err != nil {
+				retry = append(retry, v)
+				failed[&pending[i]] = err
+				continue
+			}
+			if created {
+				//list them again so the new id can be found
+				live[element] = nil
+			}
+		}
+
+		if len(retry) == len(pending) {
+			for i := range pending {
+				pending[i].result.Failed[cr.syncName(pending[i].object)] = failed[&pending[i]]
+			}
+			break
+		}
+		pending = retry
+	}
+
+	if !deleteMissing {
+		return results, nil
+	}
+
+	//a live element may still be needed by one which failed, such as the flow a failed queue still uses
+	failures := 0
+	for _, v := range results {
+		failures += len(v.Failed)
+	}
+	if failures > 0 {
+		log.Printf("%d elements failed to sync, so nothing has been deleted\n", failures)
+		return results, nil
+	}
+
+	for i, element := range syncElements {
+		inBackup := make(map[string]bool)
+		for _, v := range objects {
+			if v.element == element {
+				inBackup[cr.syncName(v)] = true
+			}
+		}
+
+		live, err := cr.liveNames(connectSvc, element)
+		if err != nil {
+			return results, errors.New("could not list the live " + string(element) + ": " + err.Error())
+		}
+
+		for name, id := range live {
+			if inBackup[name] {
+				continue
+			}
+			err = cr.deleteLive(connectSvc, element, name, id)
+			if err != nil {
+				results[i].Failed[name] = err
+			} else {
+				results[i].Deleted = append(results[i].Deleted, name)
+			}
+		}
+	}
+	return results, nil
+}
+
+//syncName is the name an element of the backup has in the instance being synced
+func (cr ConnectRestore) syncName(object backupObject) string {
+	if cr.Mapping != nil {
+		if mapped, ok := cr.Mapping.Names[object.name]; ok {
+			return mapped
+		}
+	}
+	return object.name
+}
+
+//syncElement creates or updates the live element matching a single element of the backup, reporting if it was created
+func (cr ConnectRestore) syncElement(connectSvc *connect.Connect, item syncItem, live map[string]string) (bool, error) {
+
+	name := cr.syncName(item.object)
+
+	single := cr
+	single.Element = item.result.Element
+	single.Source = item.object.location
+	single.NewName = ""
+	single.BackupRoot = ""
+	id, found := live[name]
+	if found {
+		single.targetId = id
+	} else {
+		single.NewName = name
+	}
+
+	thePlan, err := single.Plan()
+	if err != nil {
+		return false, err
+	}
+
+	if len(thePlan.Calls) == 0 {
+		item.result.Unchanged = append(item.result.Unchanged, name)
+	} else {
+		err = single.run(connectSvc, *thePlan)
+		if err != nil {
+			return false, err
+		}
+		if found {
+			item.result.Updated = append(item.result.Updated, name)
+		} else {
+			item.result.Created = append(item.result.Created, name)
+		}
+	}
+
+	if found && cr.Mapping != nil && thePlan.SourceId != "" {
+		cr.Mapping.learn(thePlan.SourceId, id)
+	}
+
+	//the id of a created element isn't known until the live elements are listed again
+	if !found && cr.Mapping != nil && thePlan.SourceId != "" {
+		created, err := cr.liveNames(connectSvc, item.result.Element)
+		if err != nil {
+			log.Println("Could not find the id of the new " + string(item.result.Element) + " " + name + ": " + err.Error())
+			return true, nil
+		}
+		if id, found = created[name]; found {
+			cr.Mapping.learn(thePlan.SourceId, id)
+		}
+	}
+	return !found, nil
+}
+
+//liveNames lists the live elements of a type by name
+func (cr ConnectRestore) liveNames(connectSvc *connect.Connect, element ConnectElement) (map[string]string, error) {
+
+	names := make(map[string]string)
+	var err error
+
+	switch element {
+	case Flows:
+		err = connectSvc.ListContactFlowsPages(&connect.ListContactFlowsInput{
+			InstanceId: cr.ConnectInstanceId,
+		}, func(output *connect.ListContactFlowsOutput, b bool) bool {
+			for _, v := range output.ContactFlowSummaryList {
+				names[*v.Name] = *v.Id
+			}
+			return true
+		})
+	case RoutingProfiles:
+		err = connectSvc.ListRoutingProfilesPages(&connect.ListRoutingProfilesInput{
+			InstanceId: cr.ConnectInstanceId,
+		}, func(output *connect.ListRoutingProfilesOutput, b bool) bool {
+			for _, v := range output.RoutingProfileSummaryList {
+				names[*v.Name] = *v.Id
+			}
+			return true
+		})
+	case Users:
+		err = connectSvc.ListUsersPages(&connect.ListUsersInput{
+			InstanceId: cr.ConnectInstanceId,
+		}, func(output *connect.ListUsersOutput, b bool) bool {
+			for _, v := range output.UserSummaryList {
+				names[*v.Username] = *v.Id
+			}
+			return true
+		})
+	case HoursOfOperation:
+		err = connectSvc.ListHoursOfOperationsPages(&connect.ListHoursOfOperationsInput{
+			InstanceId: cr.ConnectInstanceId,
+		}, func(output *connect.ListHoursOfOperationsOutput, b bool) bool {
+			for _, v := range output.HoursOfOperationSummaryList {
+				names[*v.Name] = *v.Id
+			}
+			return true
+		})
+	case Queues:
+		//agent queues aren't backed up
+		err = connectSvc.ListQueuesPages(&connect.ListQueuesInput{
+			InstanceId: cr.ConnectInstanceId,
+			QueueTypes: aws.StringSlice([]string{connect.QueueTypeStandard}),
+		}, func(output *connect.ListQueuesOutput, b bool) bool {
+			for _, v := range output.QueueSummaryList {
+				names[*v.Name] = *v.Id
+			}
+			return true
+		})
+	default:
+		err = errors.New("unexpected element type " + string(element))
+	}
+	return names, err
+}
+
+//deleteLive removes a live element which isn't in the backup, saving it first if there is somewhere to save it
+func (cr ConnectRestore) deleteLive(connectSvc *connect.Connect, element ConnectElement, name string, id string) error {
+
+	if element == RoutingProfiles || element == Queues {
+		return errors.New(string(element) + " can't be deleted through the AWS API")
+	}
+
+	if cr.Snapshot != nil {
+		live, err := cr.describeLive(connectSvc, element, id)
+		if err != nil {
+			return err
+		}
+		snapshotLocation, err := cr.snapshot(RestorePlan{
+			Element:    element,
+			InstanceId: *cr.ConnectInstanceId,
+			Name:       name,
+			live:       live,
+		})
+		if err != nil {
+			return errors.New("could not snapshot the live " + string(element) + " " + name + " before deleting: " + err.Error())
+		}
+		log.Println("Saved the live " + string(element) + " " + name + " to " + snapshotLocation)
+	}
+
+	log.Println("Deleting " + string(element) + " " + name)
+
+	var err error
+	switch element {
+	case Flows:
+		_, err = connectSvc.DeleteContactFlow(&connect.DeleteContactFlowInput{
+			InstanceId:    cr.ConnectInstanceId,
+			ContactFlowId: aws.String(id),
+		})
+	case Users:
+		_, err = connectSvc.DeleteUser(&connect.DeleteUserInput{
+			InstanceId: cr.ConnectInstanceId,
+			UserId:     aws.String(id),
+		})
+	case HoursOfOperation:
+		_, err = connectSvc.DeleteHoursOfOperation(&connect.DeleteHoursOfOperationInput{
+			InstanceId:         cr.ConnectInstanceId,
+			HoursOfOperationId: aws.String(id),
+		})
+	}
+	return err
+}
+
+//PrintSyncSummary lists what a sync did and returns the number of elements which failed
+func PrintSyncSummary(results []SyncResult, out io.Writer) int {
+
+	var failed int
+	for _, v := range results {
+		fmt.Fprintf(out, "%s: %d created, %d updated, %d unchanged, %d deleted, %d failed\n", v.Element,
+			len(v.Created), len(v.Updated), len(v.Unchanged), len(v.Deleted), len(v.Failed))
+
+		printNames(out, "created", v.Created)
+		printNames(out, "updated", v.Updated)
+		printNames(out, "deleted", v.Deleted)
+
+		var names []string
+		for name := range v.Failed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintln(out, "  failed "+name+": "+v.Failed[name].Error())
+		}
+		failed += len(v.Failed)
+	}
+	return failed
+}
+
+func printNames(out io.Writer, action string, names []string) {
+	sort.Strings(names)
+	for _, v := range names {
+		fmt.Fprintln(out, "  "+action+" "+v)
+	}
+}
@@ -0,0 +1,294 @@
+package connect_backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/connect"
+)
+
+//BackupProblem is something wrong with a single element, or the manifest, of a backup
+type BackupProblem struct {
+	Location string
+	Problem  string
+}
+
+//backupGroup is the elements of a single backup of an instance, either the instance directory or one of its snapshots
+type backupGroup struct {
+	label   string
+	objects []backupObject
+}
+
+//elementDocument returns a value of the type an element is backed up as, which its document can be decoded into.
+//It is the reverse of describeElement and describeList.
+func elementDocument(element ConnectElement) (interface{}, bool) {
+	switch element {
+	case Flows:
+		return &connect.ContactFlow{}, true
+	case FlowModules:
+		return &connect.ContactFlowModule{}, true
+	case FlowsRaw:
+		return &map[string]interface{}{}, true
+	case RoutingProfiles:
+		return &connect.RoutingProfile{}, true
+	case RoutingProfileQueues:
+		return &[]*connect.RoutingProfileQueueConfigSummary{}, true
+	case Users:
+		return &connect.User{}, true
+	case UserHierarchyGroups:
+		return &connect.HierarchyGroup{}, true
+	case UserHierarchyStructure:
+		return &connect.HierarchyStructure{}, true
+	case Prompts:
+		return &[]*connect.PromptSummary{}, true
+	case HoursOfOperation:
+		return &connect.HoursOfOperation{}, true
+	case QuickConnects:
+		return &[]*connect.QuickConnectSummary{}, true
+	case Queues:
+		return &connect.Queue{}, true
+	case Instance:
+		return &connect.Instance{}, true
+	case Attributes:
+		return &[]*connect.Attribute{}, true
+	case Lambdas:
+		return &lambdaStrings{}, true
+	case StorageConfigs:
+		return &instanceStorageConfigs{}, true
+	case LexBots:
+		return &[]*connect.LexBot{}, true
+	}
+	return nil, false
+}
+
+//VerifyBackup checks every backup of an instance, and every snapshot, under a local directory, S3 prefix or archive.
+//Each element is checked against the checksum in the manifest and decoded into the type it was backed up from, then
+//the ids users, routing profiles and queues refer to are checked to be in the same backup.  Encrypted backups are
+//decrypted with KMS, or with keys if they were encrypted with a local key.
+func VerifyBackup(sess *session.Session, root string, keys KeyWrapper) ([]BackupProblem, error) {
+
+	cr := ConnectRestore{
+		Session: *sess,
+	}
+	objects, _, err := cr.listAll(root)
+	if err != nil {
+		return nil, err
+	}
+	//an empty root is most likely the wrong one, rather than a backup with nothing wrong with it
+	if len(objects) == 0 {
+		return nil, errors.New("no backup elements found under " + root)
+	}
+
+	groups := make(map[string]*backupGroup)
+	var labels []string
+	for _, v := range objects {
+		label := v.instance
+		if v.snapshot != "" {
+			label += "/" + v.snapshot
+		}
+		if groups[label] == nil {
+			groups[label] = &backupGroup{label: label}
+			labels = append(labels, label)
+		}
+		groups[label].objects = append(groups[label].objects, v)
+	}
+	sort.Strings(labels)
+
+	var problems []BackupProblem
+	for _, v := range labels {
+		found, err := verifyGroup(sess, keys, *groups[v])
+		if err != nil {
+			return problems, err
+		}
+		problems = append(problems, found...)
+	}
+	return problems, nil
+}
+
+//verifyGroup checks the elements of a single backup of an instance
+func verifyGroup(sess *session.Session, keys KeyWrapper, group backupGroup) ([]BackupProblem, error) {
+
+	source, _, err := openSource(group.objects[0].location, sess, "", time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	reader := &DecryptingReader{
+		Reader: source,
+		Sess:   sess,
+		Keys:   keys,
+	}
+
+	var problems []BackupProblem
+	problem := func(path string, message string) {
+		problems = append(problems, BackupProblem{
+			Location: group.label + "/" + path,
+			Problem:  message,
+		})
+	}
+
+	//the manifest lists the elements by their path, the same way they are found in the backup
+	var manifest BackupManifest
+	expected := make(map[string]ManifestEntry)
+	manifestPath := Element{Type: Manifest}.Path("/")
+	document, err := reader.Read(Element{Type: Manifest, Name: string(Manifest)})
+	if err != nil {
+		problem(manifestPath, "no manifest could be read, the backup can't be checked for missing elements: "+err.Error())
+	} else if err = json.Unmarshal(document, &manifest); err != nil {
+		problem(manifestPath, "could not parse the manifest: "+err.Error())
+	} else {
+		if manifest.Finished == nil {
+			problem(manifestPath, "the backup started at "+manifest.Started.Format(time.RFC3339)+" never finished")
+		}
+		for _, v := range manifest.Failed {
+			problem(manifestPath, "part of the backup failed: "+v)
+		}
+		for _, v := range manifest.Elements {
+			expected[v.Path] = v
+		}
+	}
+
+	//decoded documents by type and name, used to check the references between them
+	decoded := make(map[ConnectElement]map[string]interface{})
+	formats := make(map[string]Format)
+	seen := make(map[string]bool)
+	for _, v := range group.objects {
+		element := Element{Type: v.element, Name: v.name, Format: v.format}
+		documentType := v.element
+		if v.element == common {
+			documentType = ConnectElement(v.name)
+		}
+		path := element.Path("/")
+		seen[path] = true
+		formats[string(documentType)+"/"+v.name] = v.format
+
+		document, err := reader.Read(element)
+		if err != nil {
+			problem(path, "could not be read: "+err.Error())
+			continue
+		}
+
+		if entry, ok := expected[path]; ok && entry.Sha256 != documentHash(document) {
+			problem(path, "does not match the checksum in the manifest")
+		} else if !ok && len(expected) > 0 {
+			problem(path, "is not in the manifest, it may be left from an earlier backup")
+		}
+
+		destination, ok := elementDocument(documentType)
+		if !ok {
+			problem(path, "is not a type of element connect-backup writes")
+			continue
+		}
+		err = unmarshalElement(document, destination)
+		if err != nil {
+			problem(path, "could not be parsed as "+string(documentType)+": "+err.Error())
+			continue
+		}
+		if decoded[documentType] == nil {
+			decoded[documentType] = make(map[string]interface{})
+		}
+		decoded[documentType][v.name] = destination
+	}
+
+	var missing []string
+	for path := range expected {
+		if !seen[path] {
+			missing = append(missing, path)
+		}
+	}
+	sort.Strings(missing)
+	for _, v := range missing {
+		problem(v, "is in the manifest but missing from the backup")
+	}
+
+	//ids of the elements in the backup, which references are checked against
+	ids := make(map[ConnectElement]map[string]bool)
+	addId := func(element ConnectElement, id *string) {
+		if ids[element] == nil {
+			ids[element] = make(map[string]bool)
+		}
+		ids[element][aws.StringValue(id)] = true
+	}
+	for _, v := range decoded[RoutingProfiles] {
+		addId(RoutingProfiles, v.(*connect.RoutingProfile).RoutingProfileId)
+	}
+	for _, v := range decoded[Queues] {
+		addId(Queues, v.(*connect.Queue).QueueId)
+	}
+	for _, v := range decoded[UserHierarchyGroups] {
+		addId(UserHierarchyGroups, v.(*connect.HierarchyGroup).Id)
+	}
+	for _, v := range decoded[HoursOfOperation] {
+		addId(HoursOfOperation, v.(*connect.HoursOfOperation).HoursOfOperationId)
+	}
+
+	//pathOf is the path of a decoded element, in the format it was written in
+	pathOf := func(element ConnectElement, name string) string {
+		return Element{Type: element, Name: name, Format: formats[string(element)+"/"+name]}.Path("/")
+	}
+	refer := func(path string, what string, element ConnectElement, id *string) {
+		if id != nil && !ids[element][*id] {
+			problem(path, what+" ("+*id+") is not in the backup")
+		}
+	}
+
+	for _, name := range sortedNames(decoded[Users]) {
+		user := decoded[Users][name].(*connect.User)
+		path := pathOf(Users, name)
+		refer(path, "routing profile", RoutingProfiles, user.RoutingProfileId)
+		refer(path, "hierarchy group", UserHierarchyGroups, user.HierarchyGroupId)
+	}
+
+	for _, name := range sortedNames(decoded[RoutingProfiles]) {
+		profile := decoded[RoutingProfiles][name].(*connect.RoutingProfile)
+		path := pathOf(RoutingProfiles, name)
+		refer(path, "default outbound queue", Queues, profile.DefaultOutboundQueueId)
+
+		queues, ok := decoded[RoutingProfileQueues][aws.StringValue(profile.RoutingProfileId)]
+		if !ok {
+			problem(path, "the queues of the routing profile are not in the backup")
+			continue
+		}
+		queuesPath := pathOf(RoutingProfileQueues, aws.StringValue(profile.RoutingProfileId))
+		for _, v := range *queues.(*[]*connect.RoutingProfileQueueConfigSummary) {
+			refer(queuesPath, "queue "+aws.StringValue(v.QueueName), Queues, v.QueueId)
+		}
+	}
+
+	for _, name := range sortedNames(decoded[Queues]) {
+		queue := decoded[Queues][name].(*connect.Queue)
+		refer(pathOf(Queues, name), "hours of operation", HoursOfOperation, queue.HoursOfOperationId)
+	}
+
+	return problems, nil
+}
+
+func sortedNames(elements map[string]interface{}) []string {
+	var names []string
+	for k := range elements {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//PrintBackupProblems reports the problems found by VerifyBackup and returns how many there were
+func PrintBackupProblems(problems []BackupProblem, out io.Writer) int {
+	if len(problems) == 0 {
+		fmt.Fprintln(out, "No problems found")
+		return 0
+	}
+
+	fmt.Fprintln(out, "Problems:")
+	for _, v := range problems {
+		fmt.Fprintln(out, "  "+v.Location+": "+v.Problem)
+	}
+	fmt.Fprintln(out, strconv.Itoa(len(problems))+" problems found")
+	return len(problems)
+}
@@ -0,0 +1,132 @@
+package connect_backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//When a routing profile is restored from a particular version, its queues are taken from the version written within
+//this long after it.  The queues are written just after the routing profile by the same backup.
+const queueVersionWindow = time.Minute
+
+type objectVersion struct {
+	VersionId    string
+	LastModified time.Time
+	IsLatest     bool
+	Size         int64
+	DeleteMarker bool
+}
+
+//objectVersions lists every version of a single object in a versioned bucket, newest first.  The key is cleaned the
+//way the SDK cleans it when the object is written, so that the versions listed match it.
+func objectVersions(s3Svc *s3.S3, bucket string, key string) ([]objectVersion, error) {
+
+	key = s3Key(key)
+	var versions []objectVersion
+	err := s3Svc.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(key),
+	}, func(output *s3.ListObjectVersionsOutput, b bool) bool {
+		for _, v := range output.Versions {
+			if *v.Key != key {
+				continue
+			}
+			versions = append(versions, objectVersion{
+				VersionId:    aws.StringValue(v.VersionId),
+				LastModified: *v.LastModified,
+				IsLatest:     aws.BoolValue(v.IsLatest),
+				Size:         aws.Int64Value(v.Size),
+			})
+		}
+		for _, v := range output.DeleteMarkers {
+			if *v.Key != key {
+				continue
+			}
+			versions = append(versions, objectVersion{
+				VersionId:    aws.StringValue(v.VersionId),
+				LastModified: *v.LastModified,
+				IsLatest:     aws.BoolValue(v.IsLatest),
+				DeleteMarker: true,
+			})
+		}
+		return true
+	})
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].LastModified.After(versions[j].LastModified)
+	})
+	return versions, err
+}
+
+//versionAsOf finds the version of an object which was current at the given time
+func versionAsOf(s3Svc *s3.S3, bucket string, key string, asOf time.Time) (string, error) {
+
+	versions, err := objectVersions(s3Svc, bucket, key)
+	if err != nil {
+		return "", err
+	}
+
+	for _, v := range versions {
+		if v.LastModified.After(asOf) {
+			continue
+		}
+		if v.DeleteMarker {
+			return "", errors.New("s3://" + bucket + "/" + s3Key(key) + " had been deleted as of " + asOf.Format(time.RFC3339))
+		}
+		return v.VersionId, nil
+	}
+	return "", errors.New("s3://" + bucket + "/" + s3Key(key) + " did not exist as of " + asOf.Format(time.RFC3339))
+}
+
+//versionTime is when a particular version of an object was written
+func versionTime(s3Svc *s3.S3, bucket string, key string, versionId string) (time.Time, error) {
+
+	result, err := s3Svc.HeadObject(&s3.HeadObjectInput{
+		Bucket:    aws.String(bucket),
+		Key:       aws.String(s3Key(key)),
+		VersionId: aws.String(versionId),
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return *result.LastModified, nil
+}
+
+//ListVersions prints the available versions of a backed up element in S3 so one can be chosen to restore from
+func ListVersions(sess *session.Session, source string, out io.Writer) error {
+
+	s3Location, err := url.Parse(source)
+	if err != nil || s3Location.Scheme != "s3" {
+		return errors.New("versions are only available for S3 sources")
+	}
+
+	versions, err := objectVersions(s3.New(sess), s3Location.Host, s3Location.Path)
+	if err != nil {
+		return err
+	}
+
+	if len(versions) == 0 {
+		return errors.New("no versions found for " + source)
+	}
+
+	for _, v := range versions {
+		latest := ""
+		if v.IsLatest {
+			latest = " (latest)"
+		}
+		if v.DeleteMarker {
+			fmt.Fprintf(out, "%s  %s  deleted%s\n", v.LastModified.Format(time.RFC3339), v.VersionId, latest)
+		} else {
+			fmt.Fprintf(out, "%s  %s  %d bytes%s\n", v.LastModified.Format(time.RFC3339), v.VersionId, v.Size, latest)
+		}
+	}
+	return nil
+}
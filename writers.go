@@ -1,28 +1,71 @@
 package connect_backup
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/private/protocol/json/jsonutil"
 
 	"github.com/aws/aws-sdk-go/service/connect"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
+//Element describes a single element of a backup being written
+type Element struct {
+	//Type is the type of the element, which is also the directory or prefix it is written to
+	Type ConnectElement
+	//Name is the name the element is written under, e.g. the flow name, username or routing profile id for its queues
+	Name string
+	//Id is the id of the element in the instance, if it has one
+	Id string
+	//Instance is the id of the instance the element belongs to
+	Instance string
+	//Format is the format the element is written in, which sets its extension.  Elements read without a format are
+	//looked for in each.
+	Format Format
+}
+
+//Writer is a destination a backup is written to.  FileWriter, S3Writer, ArchiveWriter, GitWriter and StdoutWriter are
+//provided, other destinations can be added by implementing it.
 type Writer interface {
-	write(result interface{}) error
-	writeList(name string, result interface{}) error
-	writeFlowString(name string, flow string) error
-	init(instance string) error
+	//Init is called before the elements of an instance are written, with the instance id or the path under the
+	//destination to write them to
+	Init(instance string) error
+	//Write writes a single element.  The document is the json it is restored from, apart from raw flows which are the
+	//flow content.
+	Write(element Element, document []byte) error
+	//Location is where an element has been written, in a form that can be passed back to restore.  Writers that can't
+	//be restored from return an error.
+	Location(element Element) (string, error)
+}
+
+//LatestMarker is implemented by writers which can mark the snapshot of an instance that was last backed up in full
+type LatestMarker interface {
+	MarkLatest(instance string, snapshot string) error
+}
+
+//FinishRecorder is implemented by writers which need to know how the backup of an instance ended
+type FinishRecorder interface {
+	//Finished is called once the backup written under the path passed to Init is done, with the parts of it which
+	//failed
+	Finished(path string, failed []string)
 }
 
 type FileWriter struct {
@@ -35,10 +78,16 @@ type S3Writer struct {
 	Destination url.URL
 	//	path        string
 	Sess *session.Session
+	//Options sets the encryption, storage class, tags, Object Lock and expected owner of the objects written
+	Options S3Options
 	BaseWriter
+	lockChecked bool
 }
 
+//StdoutWriter prints each element to stdout.  With NDJSON set each element is printed on a single line in an
+//ElementEnvelope saying what it is, which restore can read back from stdin.
 type StdoutWriter struct {
+	NDJSON bool
 	BaseWriter
 }
 
@@ -52,60 +101,141 @@ const (
 	//unknown       = "unknown"
 	//pathSeparator = string(os.PathSeparator)
 	jsonExtn = ".json"
+	//the user metadata S3 objects are written with holding the sha256 of the element
+	sha256Metadata = "Sha256"
 )
 
-func buildPrefix(separator string, result interface{}) (string, error) {
+//commonElements are the instance wide elements, which are written together under common
+var commonElements = map[ConnectElement]bool{
+	UserHierarchyStructure: true,
+	Instance:               true,
+	Attributes:             true,
+	Lambdas:                true,
+	StorageConfigs:         true,
+	LexBots:                true,
+}
+
+//Path is where the element is written within the backup of an instance, using the separator given
+func (e Element) Path(separator string) string {
+	if e.Type == Manifest {
+		return string(Manifest) + jsonExtn
+	}
+	if commonElements[e.Type] {
+		return common + separator + string(e.Type) + e.Format.extension()
+	}
+	return string(e.Type) + separator + e.Name + e.Format.extension()
+}
+
+//describeElement works out the type, name and id of an element returned by the AWS API
+func describeElement(instance string, result interface{}) (Element, error) {
 
-	var objectPrefix string
+	element := Element{
+		Instance: instance,
+	}
 
 	switch result.(type) {
 	case connect.ContactFlow:
-		objectPrefix = string(Flows) + separator + *result.(connect.ContactFlow).Name + jsonExtn
+		flow := result.(connect.ContactFlow)
+		element.Type, element.Name, element.Id = Flows, *flow.Name, aws.StringValue(flow.Id)
 	case connect.ContactFlowModule:
-		objectPrefix = string(FlowModules) + separator + *result.(connect.ContactFlowModule).Name + jsonExtn
+		module := result.(connect.ContactFlowModule)
+		element.Type, element.Name, element.Id = FlowModules, *module.Name, aws.StringValue(module.Id)
 	case connect.RoutingProfile:
-		objectPrefix = string(RoutingProfiles) + separator + *result.(connect.RoutingProfile).Name + jsonExtn
-	case backupRoutingProfileQueueSummary:
-		objectPrefix = string(RoutingProfileQueues) + separator + result.(backupRoutingProfileQueueSummary).routingProfile + jsonExtn
+		profile := result.(connect.RoutingProfile)
+		element.Type, element.Name, element.Id = RoutingProfiles, *profile.Name, aws.StringValue(profile.RoutingProfileId)
 	case connect.User:
-		objectPrefix = string(Users) + separator + *result.(connect.User).Username + jsonExtn
+		user := result.(connect.User)
+		element.Type, element.Name, element.Id = Users, *user.Username, aws.StringValue(user.Id)
 	case connect.HierarchyGroup:
-		objectPrefix = string(UserHierarchyGroups) + separator + *result.(connect.HierarchyGroup).Name + jsonExtn
+		group := result.(connect.HierarchyGroup)
+		element.Type, element.Name, element.Id = UserHierarchyGroups, *group.Name, aws.StringValue(group.Id)
 	case connect.HoursOfOperation:
-		objectPrefix = string(HoursOfOperation) + separator + *result.(connect.HoursOfOperation).Name + jsonExtn
+		hours := result.(connect.HoursOfOperation)
+		element.Type, element.Name, element.Id = HoursOfOperation, *hours.Name, aws.StringValue(hours.HoursOfOperationId)
 	case []*connect.QuickConnectSummary:
-		objectPrefix = string(QuickConnects) + separator + string(QuickConnects) + jsonExtn
+		element.Type, element.Name = QuickConnects, string(QuickConnects)
 	case connect.HierarchyStructure:
-		objectPrefix = common + separator + string(UserHierarchyStructure) + jsonExtn
+		element.Type, element.Name = UserHierarchyStructure, string(UserHierarchyStructure)
 	case connect.Queue:
-		objectPrefix = string(Queues) + separator + *result.(connect.Queue).Name + jsonExtn
+		queue := result.(connect.Queue)
+		element.Type, element.Name, element.Id = Queues, *queue.Name, aws.StringValue(queue.QueueId)
 	case connect.Instance:
-		objectPrefix = common + separator + string(Instance) + jsonExtn
+		element.Type, element.Name, element.Id = Instance, string(Instance), aws.StringValue(result.(connect.Instance).Id)
 	case []*connect.Attribute:
-		objectPrefix = common + separator + string(Attributes) + jsonExtn
+		element.Type, element.Name = Attributes, string(Attributes)
 	case lambdaStrings:
-		objectPrefix = common + separator + string(Lambdas) + jsonExtn
-	case connect.LexBot:
-		objectPrefix = common + separator + string(LexBots) + jsonExtn
+		element.Type, element.Name = Lambdas, string(Lambdas)
+	case instanceStorageConfigs:
+		element.Type, element.Name = StorageConfigs, string(StorageConfigs)
+	case []*connect.LexBot:
+		element.Type, element.Name = LexBots, string(LexBots)
 	default:
-		return "", errors.New("unexpected type passed to writer")
+		return element, errors.New("unexpected type passed to writer")
 	}
-	return objectPrefix, nil
+	return element, nil
 }
 
-func buildPrefixList(name string, separator string, result interface{}) (string, error) {
+//describeList works out the type of elements which are listed rather than described, and so are written under a name
+//passed along with them
+func describeList(instance string, name string, result interface{}) (Element, error) {
 
-	var objectPrefix string
+	element := Element{
+		Instance: instance,
+		Name:     name,
+	}
 
 	switch result.(type) {
 	case []*connect.RoutingProfileQueueConfigSummary:
-		objectPrefix = string(RoutingProfileQueues) + separator + name + jsonExtn
+		element.Type, element.Id = RoutingProfileQueues, name
 	case []*connect.PromptSummary:
-		objectPrefix = string(Prompts) + separator + name + jsonExtn
+		element.Type = Prompts
 	default:
-		return "", errors.New("unexpected type passed to writer")
+		return element, errors.New("unexpected type passed to writer")
+	}
+	return element, nil
+}
+
+//writeElement writes an element returned by the AWS API to the writer
+func writeElement(w Writer, instance string, result interface{}) error {
+	element, err := describeElement(instance, result)
+	if err != nil {
+		return err
+	}
+
+	document, err := jsonutil.BuildJSON(result)
+	if err != nil {
+		return err
+	}
+	return w.Write(element, document)
+}
+
+//writeElementList writes a list of elements returned by the AWS API to the writer under the name given
+func writeElementList(w Writer, instance string, name string, result interface{}) error {
+	element, err := describeList(instance, name, result)
+	if err != nil {
+		return err
+	}
+
+	document, err := jsonutil.BuildJSON(result)
+	if err != nil {
+		return err
+	}
+	return w.Write(element, document)
+}
+
+//writeFlowString writes the content of a flow by itself, laid out so it is easy to read
+func writeFlowString(w Writer, instance string, name string, id string, flow string) error {
+	prettyString, err := prettyJSON(flow)
+	if err != nil {
+		return err
 	}
-	return objectPrefix, nil
+
+	return w.Write(Element{
+		Type:     FlowsRaw,
+		Name:     name,
+		Id:       id,
+		Instance: instance,
+	}, prettyString.Bytes())
 }
 
 func prettyJSON(flow string) (bytes.Buffer, error) {
@@ -114,7 +244,7 @@ func prettyJSON(flow string) (bytes.Buffer, error) {
 	return prettyJSON, err
 }
 
-func (fw *FileWriter) init(instance string) error {
+func (fw *FileWriter) Init(instance string) error {
 	//ensure the needed child dirs are present
 	fw.separator = string(os.PathSeparator)
 	fw.path = fw.BasePath + fw.separator + instance + fw.separator
@@ -166,165 +296,320 @@ func (fw *FileWriter) init(instance string) error {
 	return err
 }
 
-func (s3w *S3Writer) init(instance string) error {
+//Init checks the bucket has Object Lock enabled the first time it is called, if the objects are to be locked
+func (s3w *S3Writer) Init(instance string) error {
 	s3w.separator = "/"
 	s3w.path = s3w.Destination.Path + s3w.separator + instance + s3w.separator
 
+	if !s3w.lockChecked {
+		err := s3w.Options.checkObjectLock(s3.New(s3w.Sess), s3w.Destination.Host)
+		if err != nil {
+			return err
+		}
+		s3w.lockChecked = true
+	}
 	return nil
 }
 
-func (fw *StdoutWriter) init(instance string) error {
+func (fw *StdoutWriter) Init(instance string) error {
 	fw.path = string(os.PathSeparator)
 	return nil
 }
 
-//As some AWS connect elements are listed and don't have unique ids, we need to sometimes pass a name around
-
-func (fw *FileWriter) writeRawFile(fileName string, result interface{}) error {
-
-	json, err := jsonutil.BuildJSON(result)
-
-	if err != nil {
-		return err
-	}
-
-	return ioutil.WriteFile(fileName, json, 0644)
+func (fw *FileWriter) Location(element Element) (string, error) {
+	return fw.path + element.Path(fw.separator), nil
 }
 
-func (fw *FileWriter) writeList(name string, result interface{}) error {
-	//for each contact flow, write to a file with the name contact flow.
-
-	filePrefix, err := buildPrefixList(name, fw.separator, result)
-
-	if err != nil {
-		return err
-	}
-
-	return fw.writeRawFile(fw.path+filePrefix, result)
+func (s3w *S3Writer) Location(element Element) (string, error) {
+	return s3w.Destination.Scheme + "://" + s3w.Destination.Host + "/" + s3w.key(element), nil
 }
 
-func (fw *FileWriter) write(result interface{}) error {
-	//for each contact flow, write to a file with the name contact flow.
+func (*StdoutWriter) Location(_ Element) (string, error) {
+	return "", errors.New("elements written to stdout can't be restored from")
+}
 
-	filePrefix, err := buildPrefix(fw.separator, result)
+func (fw *FileWriter) Write(element Element, document []byte) error {
+	return ioutil.WriteFile(fw.path+element.Path(fw.separator), document, 0644)
+}
 
-	if err != nil {
-		return err
+func (fw *FileWriter) readWritten(element Element) ([]byte, bool, error) {
+	existing, err := ioutil.ReadFile(fw.path + element.Path(fw.separator))
+	if os.IsNotExist(err) {
+		return nil, false, nil
 	}
-
-	return fw.writeRawFile(fw.path+filePrefix, result)
+	return existing, err == nil, err
 }
 
-func (fw *FileWriter) writeFlowString(fileName string, flow string) error {
-	//for each contact flow, write to a file with the name contact flow.
-
-	filePrefix := string(FlowsRaw) + fw.separator + fileName + jsonExtn
-
-	prettyString, err := prettyJSON(flow)
+//WriteIfChanged compares the hash of the document with that of the file already written
+func (fw *FileWriter) WriteIfChanged(element Element, document []byte) (WriteResult, error) {
+	existing, found, err := fw.readWritten(element)
 	if err != nil {
-		return err
+		return "", err
 	}
-
-	return ioutil.WriteFile(fw.path+fw.separator+filePrefix, prettyString.Bytes(), 0644)
+	if !found {
+		return WriteNew, fw.Write(element, document)
+	}
+	if documentHash(existing) == documentHash(document) {
+		return WriteUnchanged, nil
+	}
+	return WriteChanged, fw.Write(element, document)
 }
 
-func (s3w *S3Writer) writeRawObj(objectPrefix string, result interface{}) error {
+func (s3w *S3Writer) Write(element Element, document []byte) error {
 	if s3w.Destination.Scheme != "s3" {
 		return errors.New("URL passes is not for S3")
 	}
 
 	svc := s3.New(s3w.Sess)
 
-	json, err := jsonutil.BuildJSON(result)
-
-	if err != nil {
-		return err
-	}
-
-	_, err = svc.PutObject(&s3.PutObjectInput{
+	_, err := svc.PutObject(s3w.Options.putObject(&s3.PutObjectInput{
 		ACL:    aws.String(s3.ObjectCannedACLBucketOwnerFullControl),
 		Bucket: aws.String(s3w.Destination.Host),
-		Body:   bytes.NewReader(json),
-		Key:    aws.String(s3w.path + s3w.separator + objectPrefix),
-	})
+		Body:   bytes.NewReader(document),
+		Key:    aws.String(s3w.key(element)),
+		//the hash is kept so incremental backups can tell if the element has changed, whatever the ETag is
+		Metadata: map[string]*string{
+			sha256Metadata: aws.String(documentHash(document)),
+		},
+	}))
 
 	return err
 }
 
-func (s3w *S3Writer) write(result interface{}) error {
-	objectPrefix, err := buildPrefix(s3w.separator, result)
+//key is the key the element is stored under, in the cleaned form S3 stores it in
+func (s3w *S3Writer) key(element Element) string {
+	return s3Key(s3w.path + s3w.separator + element.Path(s3w.separator))
+}
 
-	if err != nil {
-		return err
+func (s3w *S3Writer) readWritten(element Element) ([]byte, bool, error) {
+	if s3w.Destination.Scheme != "s3" {
+		return nil, false, errors.New("URL passes is not for S3")
 	}
 
-	return s3w.writeRawObj(objectPrefix, result)
+	result, err := s3.New(s3w.Sess).GetObject(&s3.GetObjectInput{
+		Bucket:              aws.String(s3w.Destination.Host),
+		Key:                 aws.String(s3w.key(element)),
+		ExpectedBucketOwner: optional(s3w.Options.ExpectedBucketOwner),
+	})
+	if failure, ok := err.(awserr.RequestFailure); ok && failure.StatusCode() == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer result.Body.Close()
+	existing, err := ioutil.ReadAll(result.Body)
+	return existing, err == nil, err
 }
 
-func (s3w *S3Writer) writeList(name string, result interface{}) error {
-	objectPrefix, err := buildPrefixList(name, s3w.separator, result)
-
-	if err != nil {
-		return err
+//WriteIfChanged compares the document with the hash stored with the object, or its ETag for objects written before the
+//hash was stored
+func (s3w *S3Writer) WriteIfChanged(element Element, document []byte) (WriteResult, error) {
+	if s3w.Destination.Scheme != "s3" {
+		return "", errors.New("URL passes is not for S3")
 	}
 
-	return s3w.writeRawObj(objectPrefix, result)
-}
+	svc := s3.New(s3w.Sess)
 
-func (s3w *S3Writer) writeFlowString(fileName string, flow string) error {
-	//for each contact flow, write to a file with the name contact flow.
+	result := WriteChanged
+	existing, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket:              aws.String(s3w.Destination.Host),
+		Key:                 aws.String(s3w.key(element)),
+		ExpectedBucketOwner: optional(s3w.Options.ExpectedBucketOwner),
+	})
+	if failure, ok := err.(awserr.RequestFailure); ok && failure.StatusCode() == http.StatusNotFound {
+		result = WriteNew
+	} else if err != nil {
+		return "", err
+	} else if hash, ok := existing.Metadata[sha256Metadata]; ok {
+		if aws.StringValue(hash) == documentHash(document) {
+			return WriteUnchanged, nil
+		}
+	} else if aws.StringValue(existing.ETag) == documentETag(document) {
+		return WriteUnchanged, nil
+	}
 
-	objectPrefix := string(FlowsRaw) + s3w.separator + fileName + jsonExtn
+	return result, s3w.Write(element, document)
+}
 
-	if s3w.Destination.Scheme != "s3" {
-		return errors.New("URL passes is not for S3")
+func (sw *StdoutWriter) Write(element Element, document []byte) error {
+	if sw.NDJSON {
+		return writeEnvelope(os.Stdout, element, document)
 	}
+	fmt.Println(string(document))
+	return nil
+}
 
-	prettyString, err := prettyJSON(flow)
+//MarkLatest points the latest symlink in the instance directory at the snapshot.  The link is replaced in a single
+//rename so it always points at a whole snapshot.
+func (fw *FileWriter) MarkLatest(instance string, snapshot string) error {
+	instancePath := fw.BasePath + string(os.PathSeparator) + instance + string(os.PathSeparator)
+	newLink := instancePath + latestMarker + ".new"
+	_ = os.Remove(newLink)
+	err := os.Symlink(snapshot, newLink)
 	if err != nil {
 		return err
 	}
+	return os.Rename(newLink, instancePath+latestMarker)
+}
 
+//MarkLatest writes the name of the snapshot to the latest object under the instance prefix
+func (s3w *S3Writer) MarkLatest(instance string, snapshot string) error {
 	svc := s3.New(s3w.Sess)
 
-	_, err = svc.PutObject(&s3.PutObjectInput{
+	_, err := svc.PutObject(s3w.Options.putObject(&s3.PutObjectInput{
 		ACL:    aws.String(s3.ObjectCannedACLBucketOwnerFullControl),
 		Bucket: aws.String(s3w.Destination.Host),
-		Body:   bytes.NewReader(prettyString.Bytes()),
-		Key:    aws.String(s3w.path + "/" + objectPrefix),
-	})
-
+		Body:   bytes.NewReader([]byte(snapshot)),
+		Key:    aws.String(s3Key(s3w.Destination.Path + "/" + instance + "/" + latestMarker)),
+	}))
 	return err
 }
 
-func (*StdoutWriter) write(result interface{}) error {
+//ArchiveWriter streams a backup into a single .tar.gz, .tgz or .zip archive, laid out the same way as a FileWriter.
+//The Destination is a local file or an S3 URL.  The archive is only complete once Close has been called.
+type ArchiveWriter struct {
+	Destination string
+	Sess        *session.Session
+	//Options sets the encryption, storage class, tags and expected owner of an archive written to S3
+	Options S3Options
+
+	instance string
+	out      io.WriteCloser
+	zip      *zip.Writer
+	gzip     *gzip.Writer
+	tar      *tar.Writer
+	uploaded chan error
+}
 
-	json, err := jsonutil.BuildJSON(result)
+//open starts the archive, uploading it to S3 as it is written if the destination is an S3 URL
+func (aw *ArchiveWriter) open() error {
+	if !isArchive(aw.Destination) {
+		return errors.New("archive " + aw.Destination + " must end in .tar.gz, .tgz or .zip")
+	}
 
-	if err != nil {
-		return err
+	if aw.Options.locking() {
+		return errors.New("Object Lock can't be used with an archive, as S3 needs the MD5 of each part as it is uploaded")
+	}
+
+	destination, err := url.Parse(aw.Destination)
+	if err == nil && destination.Scheme == "s3" {
+		reader, writer := io.Pipe()
+		aw.out = writer
+		aw.uploaded = make(chan error, 1)
+		go func() {
+			input := &s3manager.UploadInput{
+				ACL:                 aws.String(s3.ObjectCannedACLBucketOwnerFullControl),
+				Bucket:              aws.String(destination.Host),
+				Key:                 aws.String(destination.Path),
+				Body:                reader,
+				StorageClass:        optional(aw.Options.StorageClass),
+				Tagging:             aw.Options.tagging(),
+				ExpectedBucketOwner: optional(aw.Options.ExpectedBucketOwner),
+			}
+			if aw.Options.KMSKeyId != "" {
+				input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+				input.SSEKMSKeyId = aws.String(aw.Options.KMSKeyId)
+			}
+			_, err := s3manager.NewUploader(aw.Sess).Upload(input)
+			reader.CloseWithError(err)
+			aw.uploaded <- err
+		}()
+	} else {
+		aw.out, err = os.Create(aw.Destination)
+		if err != nil {
+			return err
+		}
+	}
+
+	if strings.HasSuffix(aw.Destination, ".zip") {
+		aw.zip = zip.NewWriter(aw.out)
+	} else {
+		aw.gzip = gzip.NewWriter(aw.out)
+		aw.tar = tar.NewWriter(aw.gzip)
+	}
+	return nil
+}
+
+func (aw *ArchiveWriter) Init(instance string) error {
+	aw.instance = instance
+	if aw.out == nil {
+		return aw.open()
 	}
-	fmt.Println(string(json))
 	return nil
 }
 
-func (*StdoutWriter) writeList(_ string, result interface{}) error {
+func (aw *ArchiveWriter) Location(element Element) (string, error) {
+	return aw.Destination + archiveSeparator + aw.instance + "/" + element.Path("/"), nil
+}
+
+func (aw *ArchiveWriter) Write(element Element, document []byte) error {
+	return aw.add(aw.instance+"/"+element.Path("/"), document)
+}
+
+//add writes a single file into the archive
+func (aw *ArchiveWriter) add(name string, document []byte) error {
+	if aw.out == nil {
+		return errors.New("the archive must be initialised before it is written to")
+	}
 
-	json, err := jsonutil.BuildJSON(result)
+	if aw.zip != nil {
+		entry, err := aw.zip.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = entry.Write(document)
+		return err
+	}
 
+	err := aw.tar.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(document)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	})
 	if err != nil {
 		return err
 	}
-	fmt.Println(string(json))
-	return nil
+	_, err = aw.tar.Write(document)
+	return err
 }
 
-func (fw *StdoutWriter) writeFlowString(_ string, flow string) error {
+//MarkLatest adds a latest file to the instance directory of the archive holding the name of the snapshot
+func (aw *ArchiveWriter) MarkLatest(instance string, snapshot string) error {
+	return aw.add(instance+"/"+latestMarker, []byte(snapshot))
+}
 
-	prettyString, err := prettyJSON(flow)
-	if err == nil {
-		fmt.Println(prettyString.String())
+//Close finishes the archive and waits for it to be uploaded if it is going to S3
+func (aw *ArchiveWriter) Close() error {
+	if aw.out == nil {
+		return nil
 	}
 
+	var err error
+	if aw.zip != nil {
+		err = aw.zip.Close()
+	} else {
+		err = aw.tar.Close()
+		if err == nil {
+			err = aw.gzip.Close()
+		}
+	}
+
+	if writer, ok := aw.out.(*io.PipeWriter); ok {
+		writer.CloseWithError(err)
+		uploadErr := <-aw.uploaded
+		if err == nil {
+			err = uploadErr
+		}
+	} else if closeErr := aw.out.Close(); err == nil {
+		err = closeErr
+	}
+	aw.out = nil
 	return err
 }